@@ -179,7 +179,23 @@ async function uploadVideoFile(videoID) {
 			throw new Error(`Failed to upload video file. Error: ${data.error}`);
 		}
 
-		console.log("Video uploaded!");
+		const { job_id } = await res.json();
+		console.log("Video uploaded, processing...");
+		const uploadBtn = document.getElementById(uploadBtnSelector);
+		const progress = watchVideoProgress(videoID, (event) => {
+			if (event.status !== "processing" || !event.stage) return;
+			let text = `${event.stage[0].toUpperCase()}${event.stage.slice(1)} ${Math.floor(event.percent)}%`;
+			if (event.eta_seconds !== undefined) {
+				text += ` (~${Math.ceil(event.eta_seconds)}s left)`;
+			}
+			uploadBtn.textContent = text;
+		});
+		try {
+			await waitForJob(job_id);
+		} finally {
+			progress.abort();
+		}
+		console.log("Video processed!");
 		await getVideo(videoID);
 	} catch (error) {
 		alert(`Error: ${error.message}`);
@@ -188,6 +204,64 @@ async function uploadVideoFile(videoID) {
 	setUploadButtonState(false, uploadBtnSelector);
 }
 
+async function waitForJob(jobID) {
+	while (true) {
+		const res = await fetch(`/api/jobs/${jobID}`, {
+			headers: {
+				Authorization: `Bearer ${localStorage.getItem("token")}`,
+			},
+		});
+		if (!res.ok) {
+			const data = await res.json();
+			throw new Error(`Failed to get job. Error: ${data.error}`);
+		}
+
+		const job = await res.json();
+		if (job.state === "succeeded") return;
+		if (job.state === "failed") {
+			throw new Error(`Failed to process video. Error: ${job.last_error}`);
+		}
+		await new Promise((resolve) => setTimeout(resolve, 2000));
+	}
+}
+
+// watchVideoProgress reads the video's progress event stream, calling onEvent
+// with each event until the returned controller is aborted. EventSource can't
+// send an Authorization header, so the stream is read with fetch.
+function watchVideoProgress(videoID, onEvent) {
+	const controller = new AbortController();
+	(async () => {
+		const res = await fetch(`/api/videos/${videoID}/events`, {
+			headers: {
+				Authorization: `Bearer ${localStorage.getItem("token")}`,
+			},
+			signal: controller.signal,
+		});
+		if (!res.ok) return;
+
+		const reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+		let buffer = "";
+		while (true) {
+			const { value, done } = await reader.read();
+			if (done) return;
+			buffer += value;
+			let end;
+			while ((end = buffer.indexOf("\n\n")) !== -1) {
+				const message = buffer.slice(0, end);
+				buffer = buffer.slice(end + 2);
+				for (const line of message.split("\n")) {
+					if (line.startsWith("data: ")) {
+						onEvent(JSON.parse(line.slice(6)));
+					}
+				}
+			}
+		}
+	})().catch((error) => {
+		if (error.name !== "AbortError") console.error(error);
+	});
+	return controller;
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -275,7 +349,11 @@ function viewVideo(video) {
 			videoPlayer.style.display = "none";
 		} else {
 			videoPlayer.style.display = "block";
-			videoPlayer.src = video.video_url;
+			// Prefer adaptive streaming where the browser plays HLS natively,
+			// everything else gets the MP4
+			const canPlayHLS = videoPlayer.canPlayType("application/vnd.apple.mpegurl");
+			videoPlayer.src =
+				video.hls_url && canPlayHLS ? video.hls_url : video.video_url;
 			videoPlayer.load();
 		}
 	}
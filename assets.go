@@ -1,12 +1,13 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"crypto/sha256"
 	"fmt"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
+
+	"github.com/google/uuid"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -16,24 +17,55 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	return nil
 }
 
-func getAssetPath(mediaType string) string {
-	randomBytes := make([]byte, 32)
-	_, err := rand.Read(randomBytes) 
+// getThumbnailKey names a thumbnail after its content, so uploading the same
+// image twice doesn't create a second object.
+func getThumbnailKey(videoID uuid.UUID, data []byte, mediaType string) string {
+	sum := sha256.Sum256(data)
+	ext := mediaTypeToExt(mediaType)
+	return fmt.Sprintf("%s%x%s", getThumbnailPrefix(videoID), sum, ext)
+}
+
+func getThumbnailPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("thumbnails/%s/", videoID)
+}
+
+// getLocalAssetName returns the file name of a thumbnail that is still served
+// out of assetsRoot through the legacy /assets/ route.
+func getLocalAssetName(assetURL string) (string, bool) {
+	u, err := url.Parse(assetURL)
 	if err != nil {
-		panic("failed to get bytes")
+		return "", false
+	}
+	name, ok := strings.CutPrefix(u.Path, "/assets/")
+	if !ok || name == "" {
+		return "", false
 	}
-	id := base64.RawURLEncoding.EncodeToString(randomBytes)
+	return name, true
+}
 
-	ext := mediaTypeToExt(mediaType)
-	return fmt.Sprintf("%s%s", id, ext)
+func (cfg apiConfig) getObjectURL(key string) string {
+	return fmt.Sprintf("%s/%s", cfg.mediaBaseURL, key)
 }
 
-func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
-	return filepath.Join(cfg.assetsRoot, assetPath)
+// getObjectKey is the inverse of getObjectURL. It reports false for URLs that
+// don't point into the storage backend.
+func (cfg apiConfig) getObjectKey(objectURL string) (string, bool) {
+	key, ok := strings.CutPrefix(objectURL, cfg.mediaBaseURL+"/")
+	if !ok || key == "" {
+		return "", false
+	}
+	return key, true
 }
 
-func (cfg apiConfig) getAssetURL(assetPath string) string {
-	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
+// getVideoAssetPrefix is where files derived from a video, such as extra
+// renditions, are stored so they can be found and removed together.
+func getVideoAssetPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("videos/%s/", videoID)
+}
+
+// getVersionAssetPrefix holds the files derived from one version of a video.
+func getVersionAssetPrefix(videoID, versionID uuid.UUID) string {
+	return fmt.Sprintf("%s%s/", getVideoAssetPrefix(videoID), versionID)
 }
 
 func mediaTypeToExt(mediaType string) string {
@@ -43,5 +75,3 @@ func mediaTypeToExt(mediaType string) string {
 	}
 	return "." + parts[1]
 }
-
-
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	audioRenditionName        = "audio.m4a"
+	audioRenditionContentType = "audio/mp4"
+	audioRenditionKbps        = 128
+)
+
+// extractAudioPayload asks for the audio of a version to be stored on its
+// own.
+type extractAudioPayload struct {
+	VersionID uuid.UUID `json:"version_id"`
+}
+
+// extractAudio stores a version's audio as an AAC M4A, which browsers and
+// podcast apps play alike. Processed files already carry AAC, so it's
+// normally only remuxed, and embedded chapters come along with it. Versions
+// without audio are left alone.
+func (cfg *apiConfig) extractAudio(ctx context.Context, payload extractAudioPayload) error {
+	version, err := cfg.db.GetVideoVersion(payload.VersionID)
+	if err != nil {
+		return err
+	}
+	if version.ID == uuid.Nil {
+		return nil
+	}
+	var probe videoProbe
+	if len(version.Probe) > 0 {
+		if err := json.Unmarshal(version.Probe, &probe); err != nil {
+			return fmt.Errorf("couldn't read version probe: %w", err)
+		}
+	}
+	if probe.MediaInfo != nil && probe.MediaInfo.AudioCodec == "" {
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp("", "tubely-audio-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	sourcePath := filepath.Join(workDir, "source.mp4")
+	err = cfg.downloadObject(ctx, version.Key, sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't download version: %w", err)
+	}
+	source, err := cfg.runFFprobe(ctx, sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't probe version: %w", err)
+	}
+	audio, ok := source.audioStream()
+	if !ok {
+		return nil
+	}
+
+	outputPath := filepath.Join(workDir, audioRenditionName)
+	args := []string{"-y", "-i", sourcePath, "-map", fmt.Sprintf("0:%d", audio.Index), "-vn"}
+	if audio.CodecName == "aac" {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", audioRenditionKbps))
+	}
+	args = append(args, "-movflags", "+faststart", "-f", "ipod", outputPath)
+	err = cfg.runFFmpeg(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't extract audio: %w", err)
+	}
+
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	key := getVersionAssetPrefix(version.VideoID, version.ID) + audioRenditionName
+	err = cfg.storage.Put(ctx, key, f, storage.PutOptions{ContentType: audioRenditionContentType})
+	if err != nil {
+		return fmt.Errorf("couldn't upload audio: %w", err)
+	}
+
+	err = cfg.db.SetVideoVersionAudio(version.ID, key, info.Size())
+	if err != nil {
+		return err
+	}
+	return cfg.refreshPlayback(version.ID)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// storeVideoBlob returns the processed video for a raw upload. If the same
+// file has been processed before (see rawUpload.blobHash), its stored object
+// is reused and the upload isn't processed again.
+func (cfg *apiConfig) storeVideoBlob(ctx context.Context, upload rawUpload) (storedVideo, error) {
+	contentHash := upload.blobHash()
+	blob, found, err := cfg.db.AcquireBlob(contentHash)
+	if err != nil {
+		return storedVideo{}, fmt.Errorf("couldn't look up blob: %w", err)
+	}
+	if found {
+		return cfg.getStoredBlob(blob)
+	}
+
+	fileKey, probe, err := cfg.processVideo(ctx, upload)
+	if err != nil {
+		return storedVideo{}, err
+	}
+
+	info, err := cfg.storage.Stat(ctx, fileKey)
+	if err != nil {
+		cfg.storage.Delete(ctx, fileKey)
+		return storedVideo{}, fmt.Errorf("couldn't stat stored video: %w", err)
+	}
+
+	blob, err = cfg.db.CreateBlob(database.CreateBlobParams{
+		SHA256: contentHash,
+		Key:    fileKey,
+		Size:   info.Size,
+	})
+	if err != nil {
+		cfg.storage.Delete(ctx, fileKey)
+		return storedVideo{}, fmt.Errorf("couldn't record blob: %w", err)
+	}
+
+	// Someone else finished uploading the same file first, use theirs
+	if blob.Key != fileKey {
+		err = cfg.storage.Delete(ctx, fileKey)
+		if err != nil {
+			log.Printf("Couldn't delete duplicate upload %s: %v", fileKey, err)
+		}
+		return cfg.getStoredBlob(blob)
+	}
+
+	probeData, err := json.Marshal(probe)
+	if err != nil {
+		return storedVideo{}, err
+	}
+	return storedVideo{
+		key:   fileKey,
+		size:  info.Size,
+		probe: probeData,
+	}, nil
+}
+
+// getStoredBlob describes an existing blob, borrowing the probe data from a
+// version that already uses it.
+func (cfg *apiConfig) getStoredBlob(blob database.Blob) (storedVideo, error) {
+	version, err := cfg.db.GetVideoVersionByKey(blob.Key)
+	if err != nil {
+		return storedVideo{}, err
+	}
+	return storedVideo{
+		key:   blob.Key,
+		size:  blob.Size,
+		probe: version.Probe,
+	}, nil
+}
+
+// releaseVideoObject drops a reference to a stored video file, deleting the
+// file once no video uses it any more. Files uploaded before deduplication
+// have no blob record and are deleted straight away.
+func (cfg *apiConfig) releaseVideoObject(ctx context.Context, key string) error {
+	remaining, tracked, err := cfg.db.ReleaseBlob(key)
+	if err != nil {
+		return err
+	}
+	if tracked && remaining > 0 {
+		return nil
+	}
+	return cfg.deleteStoredObjects(ctx, []database.CreatePendingDeletionParams{
+		{Store: deletionStoreStorage, Key: key},
+	})
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxWatermarkSize = 5 << 20
+	maxBumperSize    = 100 << 20
+	// maxBumperDuration is how long an intro or outro can be, in seconds
+	maxBumperDuration = 30
+
+	defaultWatermarkPosition = "bottom-right"
+	defaultWatermarkOpacity  = 0.8
+	defaultWatermarkScale    = 0.15
+
+	// brandingSampleRate is the audio every part of a branded video is
+	// resampled to, so they can be joined
+	brandingSampleRate = 48000
+)
+
+var watermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+func getBrandingPrefix(userID uuid.UUID) string {
+	return fmt.Sprintf("branding/%s/", userID)
+}
+
+// getBrandingKey names a branding file after its contents, like thumbnails.
+// kind is "watermark", "intro" or "outro".
+func getBrandingKey(userID uuid.UUID, kind string, sum []byte, mediaType string) string {
+	return fmt.Sprintf("%s%s/%x%s", getBrandingPrefix(userID), kind, sum, mediaTypeToExt(mediaType))
+}
+
+// watermarkOverlayPosition is where ffmpeg's overlay filter puts the
+// watermark, margin pixels in from the edges.
+func watermarkOverlayPosition(position string, margin int) string {
+	switch position {
+	case "top-left":
+		return fmt.Sprintf("%d:%d", margin, margin)
+	case "top-right":
+		return fmt.Sprintf("W-w-%d:%d", margin, margin)
+	case "bottom-left":
+		return fmt.Sprintf("%d:H-h-%d", margin, margin)
+	case "center":
+		return "(W-w)/2:(H-h)/2"
+	default:
+		return fmt.Sprintf("W-w-%d:H-h-%d", margin, margin)
+	}
+}
+
+// brandingSegment is one of the videos joined into a branded upload.
+type brandingSegment struct {
+	// video and audio are ffmpeg stream specifiers, and audio is empty if
+	// the segment is silent
+	video    string
+	audio    string
+	duration float64
+}
+
+// brandingOverlay is a watermark image given to ffmpeg as input.
+type brandingOverlay struct {
+	input int
+	database.Watermark
+}
+
+// buildBrandingFilter joins the segments into one video of the main
+// segment's size and frame rate, with [v] and [a] as its outputs. Bumpers are
+// scaled to fit and letterboxed, and the watermark only covers the main
+// segment. If no segment has audio, there's no [a].
+func buildBrandingFilter(segments []brandingSegment, main int, watermark *brandingOverlay, width, height int, frameRate float64) (graph string, hasAudio bool) {
+	for _, segment := range segments {
+		if segment.audio != "" {
+			hasAudio = true
+		}
+	}
+
+	filters := []string{}
+	concat := ""
+	for i, segment := range segments {
+		label := fmt.Sprintf("v%d", i)
+		switch {
+		case i == main && watermark != nil:
+			watermarkWidth := max(2, int(float64(width)*watermark.Scale)/2*2)
+			filters = append(filters,
+				fmt.Sprintf("[%s]scale=%d:%d,setsar=1,fps=%g[main]", segment.video, width, height, frameRate),
+				fmt.Sprintf("[%d:v]scale=%d:-2,format=rgba,colorchannelmixer=aa=%g[watermark]", watermark.input, watermarkWidth, watermark.Opacity),
+				fmt.Sprintf("[main][watermark]overlay=%s,format=yuv420p[%s]", watermarkOverlayPosition(watermark.Position, max(width, height)/50), label),
+			)
+		case i == main:
+			filters = append(filters, fmt.Sprintf("[%s]scale=%d:%d,setsar=1,fps=%g,format=yuv420p[%s]", segment.video, width, height, frameRate, label))
+		default:
+			filters = append(filters, fmt.Sprintf(
+				"[%s]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%g,format=yuv420p[%s]",
+				segment.video, width, height, width, height, frameRate, label,
+			))
+		}
+		concat += "[" + label + "]"
+
+		if !hasAudio {
+			continue
+		}
+		audioFormat := fmt.Sprintf("aformat=sample_fmts=fltp:sample_rates=%d:channel_layouts=stereo", brandingSampleRate)
+		if segment.audio != "" {
+			filters = append(filters, fmt.Sprintf("[%s]aresample=%d,%s[a%d]", segment.audio, brandingSampleRate, audioFormat, i))
+		} else {
+			// Silent segments get silence, since every part needs audio to
+			// be joined
+			filters = append(filters, fmt.Sprintf("anullsrc=r=%d:cl=stereo,atrim=duration=%g,%s[a%d]", brandingSampleRate, segment.duration, audioFormat, i))
+		}
+		concat += fmt.Sprintf("[a%d]", i)
+	}
+
+	if hasAudio {
+		filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=1[v][a]", concat, len(segments)))
+	} else {
+		filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=0[v]", concat, len(segments)))
+	}
+	return strings.Join(filters, ";"), hasAudio
+}
+
+// brandVideo transcodes an upload with its owner's watermark and bumpers.
+// Everything is brought to the upload's size and frame rate, and the result
+// is a faststart MP4 like any other normalized upload. Chapters are moved
+// back by the length of the intro, which is returned as the chapter offset,
+// and the outro's length is returned so chapters can be kept out of it.
+func (cfg *apiConfig) brandVideo(ctx context.Context, upload rawUpload, source ffprobeOutput, onProgress func(fraction float64)) (path string, chapterOffset, outroLength float64, err error) {
+	branding := *upload.branding
+	video, ok := source.videoStream()
+	if !ok {
+		return "", 0, 0, fmt.Errorf("no video stream in upload")
+	}
+
+	main := brandingSegment{video: fmt.Sprintf("0:%d", video.Index)}
+	if audio, ok := source.audioStream(); ok {
+		main.audio = fmt.Sprintf("0:%d", audio.Index)
+	}
+	main.duration, _ = strconv.ParseFloat(source.Format.Duration, 64)
+
+	inputs := []string{"-i", upload.path}
+	segments := []brandingSegment{}
+	addBumper := func(key, name string) error {
+		path := upload.path + "." + name
+		defer func() { inputs = append(inputs, "-i", path) }()
+		if err := cfg.downloadObject(ctx, key, path); err != nil {
+			return fmt.Errorf("couldn't download %s: %w", name, err)
+		}
+
+		probe, err := cfg.runFFprobe(ctx, path)
+		if err != nil {
+			return fmt.Errorf("couldn't probe %s: %w", name, err)
+		}
+		bumperVideo, ok := probe.videoStream()
+		if !ok {
+			return fmt.Errorf("no video stream in %s", name)
+		}
+		input := len(inputs) / 2
+		segment := brandingSegment{video: fmt.Sprintf("%d:%d", input, bumperVideo.Index)}
+		if bumperAudio, ok := probe.audioStream(); ok {
+			segment.audio = fmt.Sprintf("%d:%d", input, bumperAudio.Index)
+		}
+		segment.duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+		segments = append(segments, segment)
+		return nil
+	}
+	defer func() {
+		for i := 3; i < len(inputs); i += 2 {
+			os.Remove(inputs[i])
+		}
+	}()
+
+	if branding.IntroKey != nil {
+		if err := addBumper(*branding.IntroKey, "intro"); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	mainIndex := len(segments)
+	segments = append(segments, main)
+	if branding.OutroKey != nil {
+		if err := addBumper(*branding.OutroKey, "outro"); err != nil {
+			return "", 0, 0, err
+		}
+	}
+
+	var watermark *brandingOverlay
+	if branding.Watermark != nil {
+		path := upload.path + ".watermark"
+		inputs = append(inputs, "-i", path)
+		if err := cfg.downloadObject(ctx, branding.Watermark.Key, path); err != nil {
+			return "", 0, 0, fmt.Errorf("couldn't download watermark: %w", err)
+		}
+		watermark = &brandingOverlay{input: len(inputs)/2 - 1, Watermark: *branding.Watermark}
+	}
+
+	var duration float64
+	for _, segment := range segments {
+		if segment.duration <= 0 {
+			return "", 0, 0, errors.New("couldn't tell how long the upload or its bumpers are")
+		}
+		duration += segment.duration
+	}
+
+	// The video's own content starts once the intro is over
+	chapterOffset = upload.chapterOffset
+	for _, segment := range segments[:mainIndex] {
+		chapterOffset += segment.duration
+	}
+	outroLength = upload.outroLength
+	for _, segment := range segments[mainIndex+1:] {
+		outroLength += segment.duration
+	}
+	chaptersPath, err := writeChapterMetadata(upload.path, offsetChapters(upload.chapters, chapterOffset), duration)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if chaptersPath != "" {
+		defer os.Remove(chaptersPath)
+	}
+
+	width, height := displaySize(database.MediaInfo{
+		Width:             video.Width,
+		Height:            video.Height,
+		SampleAspectRatio: video.SampleAspectRatio,
+		Rotation:          video.rotation(),
+	})
+	graph, hasAudio := buildBrandingFilter(segments, mainIndex, watermark, width, height, mezzanineFrameRate(video))
+
+	outputPath := upload.path + ".processing"
+	args := append([]string{"-y"}, inputs...)
+	if chaptersPath != "" {
+		args = append(args, chapterMetadataArgs(chaptersPath, len(inputs)/2)...)
+	} else {
+		// Chapters in the upload itself don't allow for the intro
+		args = append(args, "-map_chapters", "-1")
+	}
+	args = append(args,
+		"-filter_complex", graph,
+		"-map", "[v]",
+		"-c:v", "libx264", "-preset", "medium", "-crf", "20", "-profile:v", "high",
+	)
+	if hasAudio {
+		args = append(args, "-map", "[a]", "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args, "-movflags", "+faststart", "-f", "mp4", outputPath)
+
+	err = cfg.runFFmpegWithProgress(ctx, secondsToDuration(duration), onProgress, args...)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("couldn't brand upload: %w", err)
+	}
+	return outputPath, chapterOffset, outroLength, nil
+}
+
+// getUploadBranding is the branding a video's uploads are processed with, or
+// nil if there's none.
+func (cfg *apiConfig) getUploadBranding(video database.Video) (*database.Branding, error) {
+	branding, err := cfg.db.GetBranding(video.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if branding.Empty() {
+		return nil, nil
+	}
+	return &branding, nil
+}
+
+// writeBrandingFingerprint writes everything in a user's branding that
+// affects a processed file, for telling blobs apart (see rawUpload.blobHash).
+func writeBrandingFingerprint(w io.Writer, branding database.Branding) {
+	if branding.Watermark != nil {
+		fmt.Fprintf(w, "\nwatermark\t%s\t%s\t%g\t%g", branding.Watermark.Key, branding.Watermark.Position, branding.Watermark.Opacity, branding.Watermark.Scale)
+	}
+	if branding.IntroKey != nil {
+		fmt.Fprintf(w, "\nintro\t%s", *branding.IntroKey)
+	}
+	if branding.OutroKey != nil {
+		fmt.Fprintf(w, "\noutro\t%s", *branding.OutroKey)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const maxCaptionSize = 1 << 20
+
+// captionLanguagePattern accepts BCP 47 tags such as "en", "pt-BR" or
+// "zh-Hant-TW", without checking the subtags are registered.
+var captionLanguagePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// normalizeCaptionLanguage checks a language tag and puts it in its usual
+// case, so "PT-br" and "pt-BR" are the same track.
+func normalizeCaptionLanguage(tag string) (string, bool) {
+	if !captionLanguagePattern.MatchString(tag) {
+		return "", false
+	}
+	subtags := strings.Split(tag, "-")
+	subtags[0] = strings.ToLower(subtags[0])
+	for i := 1; i < len(subtags); i++ {
+		switch len(subtags[i]) {
+		case 2:
+			subtags[i] = strings.ToUpper(subtags[i])
+		case 4:
+			subtags[i] = strings.ToUpper(subtags[i][:1]) + strings.ToLower(subtags[i][1:])
+		default:
+			subtags[i] = strings.ToLower(subtags[i])
+		}
+	}
+	return strings.Join(subtags, "-"), true
+}
+
+// getCaptionKey names a caption file after its contents, like thumbnails, so
+// a replaced track never shows up stale from a cache.
+func getCaptionKey(videoID uuid.UUID, language string, data []byte) string {
+	return fmt.Sprintf("%scaptions/%s/%x.vtt", getVideoAssetPrefix(videoID), language, sha256.Sum256(data))
+}
+
+// captionCue is one timed piece of caption text.
+type captionCue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  []string
+}
+
+// toWebVTT checks an uploaded caption file and returns it as WebVTT. WebVTT
+// input is kept as it is, apart from line endings, so styling survives. SRT
+// is converted.
+func toWebVTT(data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	if isWebVTT(text) {
+		if err := validateWebVTT(text); err != nil {
+			return nil, err
+		}
+		return []byte(text), nil
+	}
+
+	cues, err := parseSRT(text)
+	if err != nil {
+		return nil, err
+	}
+	return buildWebVTT(cues), nil
+}
+
+func isWebVTT(text string) bool {
+	rest, ok := strings.CutPrefix(text, "WEBVTT")
+	return ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n')
+}
+
+// validateWebVTT makes sure every cue in a WebVTT file has sensible timings.
+func validateWebVTT(text string) error {
+	blocks := splitCaptionBlocks(text)
+	cues := 0
+	// The first block is the header
+	for i, block := range blocks[1:] {
+		lines := strings.Split(block, "\n")
+		if strings.HasPrefix(lines[0], "NOTE") || lines[0] == "STYLE" || lines[0] == "REGION" {
+			continue
+		}
+		cues++
+		timing := lines[0]
+		if !strings.Contains(timing, "-->") && len(lines) > 1 {
+			// The line before the timings is an optional cue identifier
+			timing = lines[1]
+		}
+		fields := strings.Fields(timing)
+		if len(fields) < 3 || fields[1] != "-->" {
+			return fmt.Errorf("block %d: expected cue timings, got %q", i+1, timing)
+		}
+		if _, _, err := parseCueTimings(fields[0], fields[2]); err != nil {
+			return fmt.Errorf("block %d: %w", i+1, err)
+		}
+	}
+	if cues == 0 {
+		return errors.New("no cues found")
+	}
+	return nil
+}
+
+// parseSRT reads SubRip cues: an index, a timing line such as
+// "00:00:01,000 --> 00:00:04,000" and the cue text.
+func parseSRT(text string) ([]captionCue, error) {
+	blocks := splitCaptionBlocks(text)
+	if len(blocks) == 0 {
+		return nil, errors.New("no cues found")
+	}
+
+	cues := make([]captionCue, 0, len(blocks))
+	for i, block := range blocks {
+		lines := strings.Split(block, "\n")
+		if _, err := strconv.Atoi(strings.TrimSpace(lines[0])); err == nil {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("cue %d: missing timings", i+1)
+		}
+
+		// Some SRT files add display coordinates after the end time
+		fields := strings.Fields(lines[0])
+		if len(fields) < 3 || fields[1] != "-->" {
+			return nil, fmt.Errorf("cue %d: expected timings, got %q", i+1, lines[0])
+		}
+		start, end, err := parseCueTimings(fields[0], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("cue %d: %w", i+1, err)
+		}
+		cues = append(cues, captionCue{Start: start, End: end, Text: lines[1:]})
+	}
+	return cues, nil
+}
+
+// buildWebVTT writes cues as a WebVTT file. Their text is plain, apart from
+// the bold, italic and underline tags SRT and WebVTT share (see
+// escapeCueText).
+func buildWebVTT(cues []captionCue) []byte {
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "\n%s --> %s\n", formatVTTTimestamp(cue.Start.Seconds()), formatVTTTimestamp(cue.End.Seconds()))
+		for _, line := range cue.Text {
+			b.WriteString(escapeCueText(line))
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes()
+}
+
+// cueStyleTagPattern matches the formatting tags SRT and WebVTT both have.
+var cueStyleTagPattern = regexp.MustCompile(`(?i)</?[biu]>`)
+
+// cueFontTagPattern matches SRT font tags, which WebVTT has no equivalent for.
+var cueFontTagPattern = regexp.MustCompile(`(?i)</?font(\s[^>]*)?>`)
+
+// A literal "-->" would be read as the start of a new cue, and "&" and "<"
+// as the start of an entity or a tag
+var cueTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", "-->", "--&gt;")
+
+// escapeCueText makes a line of plain cue text safe for WebVTT, keeping bold,
+// italic and underline tags and dropping font tags.
+func escapeCueText(line string) string {
+	line = cueFontTagPattern.ReplaceAllString(line, "")
+	var b strings.Builder
+	last := 0
+	for _, loc := range cueStyleTagPattern.FindAllStringIndex(line, -1) {
+		b.WriteString(cueTextEscaper.Replace(line[last:loc[0]]))
+		b.WriteString(strings.ToLower(line[loc[0]:loc[1]]))
+		last = loc[1]
+	}
+	b.WriteString(cueTextEscaper.Replace(line[last:]))
+	return b.String()
+}
+
+var captionBlockSeparator = regexp.MustCompile(`\n[ \t]*\n`)
+
+// splitCaptionBlocks splits caption text on blank lines.
+func splitCaptionBlocks(text string) []string {
+	blocks := []string{}
+	for _, block := range captionBlockSeparator.Split(text, -1) {
+		block = strings.Trim(block, "\n")
+		if strings.TrimSpace(block) != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+func parseCueTimings(startText, endText string) (time.Duration, time.Duration, error) {
+	start, err := parseCaptionTimestamp(startText)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseCaptionTimestamp(endText)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("cue ends at %s, before it starts at %s", endText, startText)
+	}
+	return start, end, nil
+}
+
+// captionTimestampPattern matches WebVTT's "[hh:]mm:ss.ttt" and SRT's
+// "hh:mm:ss,ttt".
+var captionTimestampPattern = regexp.MustCompile(`^(?:(\d+):)?(\d{2}):(\d{2})[.,](\d{3})$`)
+
+func parseCaptionTimestamp(s string) (time.Duration, error) {
+	match := captionTimestampPattern.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	hours := 0
+	if match[1] != "" {
+		hours, _ = strconv.Atoi(match[1])
+	}
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.Atoi(match[3])
+	millis, _ := strconv.Atoi(match[4])
+	if minutes > 59 || seconds > 59 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second +
+		time.Duration(millis)*time.Millisecond, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCaptionTimestamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "srt comma", input: "00:01:02,345", want: time.Minute + 2345*time.Millisecond},
+		{name: "webvtt dot", input: "00:01:02.345", want: time.Minute + 2345*time.Millisecond},
+		{name: "missing hours", input: "01:02.345", want: time.Minute + 2345*time.Millisecond},
+		{name: "long hours", input: "100:00:00.000", want: 100 * time.Hour},
+		{name: "minutes out of range", input: "00:60:00,000", wantErr: true},
+		{name: "seconds out of range", input: "00:00:60,000", wantErr: true},
+		{name: "short millis", input: "00:00:01,5", wantErr: true},
+		{name: "no fraction", input: "00:00:01", wantErr: true},
+		{name: "single digit minutes", input: "1:02.345", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCaptionTimestamp(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCaptionTimestamp(%q) = %v, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCaptionTimestamp(%q) returned error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseCaptionTimestamp(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToWebVTT(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "srt",
+			input: "1\n00:00:01,000 --> 00:00:02,500\nHello\nthere\n\n2\n00:00:03,000 --> 00:00:04,000\nBye\n",
+			want:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\nthere\n\n00:00:03.000 --> 00:00:04.000\nBye\n",
+		},
+		{
+			name:  "srt with crlf and bom",
+			input: "\xef\xbb\xbf1\r\n00:00:01,000 --> 00:00:02,000\r\nHello\r\n\r\n",
+			want:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n",
+		},
+		{
+			name:  "srt with display coordinates",
+			input: "1\n00:00:01,000 --> 00:00:02,000 X1:10 X2:20 Y1:30 Y2:40\nHello\n",
+			want:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n",
+		},
+		{
+			name:  "srt without index",
+			input: "00:00:01,000 --> 00:00:02,000\nHello\n",
+			want:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello\n",
+		},
+		{
+			name:  "srt text is escaped",
+			input: "1\n00:00:01,000 --> 00:00:02,000\nTom & Jerry <3\nwait --> what\n",
+			want:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nTom &amp; Jerry &lt;3\nwait --&gt; what\n",
+		},
+		{
+			name:  "srt style tags are kept",
+			input: "1\n00:00:01,000 --> 00:00:02,000\n<I>Hi</I> <b>&</b> <font color=\"red\">red</font>\n",
+			want:  "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\n<i>Hi</i> <b>&amp;</b> red\n",
+		},
+		{
+			name:  "webvtt is kept",
+			input: "WEBVTT\r\n\r\n00:01.000 --> 00:02.000\r\n<c.yellow>Hi</c> &amp; bye\r\n",
+			want:  "WEBVTT\n\n00:01.000 --> 00:02.000\n<c.yellow>Hi</c> &amp; bye\n",
+		},
+		{
+			name:    "srt ending before it starts",
+			input:   "1\n00:00:02,000 --> 00:00:01,000\nHello\n",
+			wantErr: true,
+		},
+		{
+			name:    "webvtt with bad timings",
+			input:   "WEBVTT\n\n00:01.000 -> 00:02.000\nHello\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			input:   "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toWebVTT([]byte(tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("toWebVTT() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("toWebVTT() returned error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("toWebVTT() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
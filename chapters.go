@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const maxChapterTitleLength = 100
+
+var errChapterStartTaken = errors.New("another chapter already starts then")
+
+// normalizeChapterTitle collapses a title onto one line, since both WebVTT
+// cues and MP4 chapter names are shown as a single line anyway.
+func normalizeChapterTitle(title string) (string, error) {
+	title = strings.Join(strings.Fields(title), " ")
+	if title == "" {
+		return "", errors.New("title is required")
+	}
+	if len([]rune(title)) > maxChapterTitleLength {
+		return "", fmt.Errorf("title can't be longer than %d characters", maxChapterTitleLength)
+	}
+	return title, nil
+}
+
+// validateChapter checks a new or edited chapter against the length of the
+// video's own content (see getContentDuration) and the rest of its chapters.
+// Until the video has been probed its duration is unknown (0), so chapters
+// past the end are only left out when they're published.
+func validateChapter(duration float64, chapters []database.Chapter, chapter database.Chapter) error {
+	if chapter.StartTime < 0 || math.IsNaN(chapter.StartTime) || math.IsInf(chapter.StartTime, 0) {
+		return errors.New("start_time must be a number of seconds from the start of the video")
+	}
+	if duration > 0 && chapter.StartTime >= duration {
+		return fmt.Errorf("start_time must be before the end of the video at %s", formatVTTTimestamp(duration))
+	}
+	for _, other := range chapters {
+		if other.ID != chapter.ID && other.StartTime == chapter.StartTime {
+			return errChapterStartTaken
+		}
+	}
+	return nil
+}
+
+// descriptionChapterPattern matches description lines such as "00:00 Intro",
+// "1:02:03 - Wrap up" or "(12:30) Questions".
+var descriptionChapterPattern = regexp.MustCompile(`^[(\[]?((?:\d{1,2}:)?\d{1,2}:\d{2})[)\]]?\s*(?:[-–—|:]\s*)?(\S.*)$`)
+
+// parseDescriptionChapters finds chapters listed in a video description, one
+// timestamp and title per line. Like other video sites, the list only counts
+// if it starts at 0:00 and has at least two chapters in order, so the odd
+// timestamp in a description isn't mistaken for one.
+func parseDescriptionChapters(videoID uuid.UUID, description string) []database.CreateChapterParams {
+	chapters := []database.CreateChapterParams{}
+	for _, line := range strings.Split(description, "\n") {
+		match := descriptionChapterPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		start, ok := parseChapterTimestamp(match[1])
+		if !ok {
+			return nil
+		}
+		title, err := normalizeChapterTitle(match[2])
+		if err != nil {
+			return nil
+		}
+		if len(chapters) > 0 && start <= chapters[len(chapters)-1].StartTime {
+			return nil
+		}
+		chapters = append(chapters, database.CreateChapterParams{
+			VideoID:   videoID,
+			StartTime: start,
+			Title:     title,
+		})
+	}
+	if len(chapters) < 2 || chapters[0].StartTime != 0 {
+		return nil
+	}
+	return chapters
+}
+
+// parseChapterTimestamp reads "m:ss" or "h:mm:ss" as seconds.
+func parseChapterTimestamp(s string) (float64, bool) {
+	parts := strings.Split(s, ":")
+	seconds := 0
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || (i > 0 && n > 59) {
+			return 0, false
+		}
+		seconds = seconds*60 + n
+	}
+	return float64(seconds), true
+}
+
+// chapterCues turns chapters into cues running from each chapter's start to
+// the next one's, leaving out any that start after the video ends.
+func chapterCues(chapters []database.Chapter, duration float64) []captionCue {
+	cues := []captionCue{}
+	for i, chapter := range chapters {
+		if chapter.StartTime >= duration {
+			break
+		}
+		end := duration
+		if i+1 < len(chapters) && chapters[i+1].StartTime < duration {
+			end = chapters[i+1].StartTime
+		}
+		cues = append(cues, captionCue{
+			Start: secondsToDuration(chapter.StartTime),
+			End:   secondsToDuration(end),
+			Text:  []string{chapter.Title},
+		})
+	}
+	return cues
+}
+
+// offsetChapters moves chapters later by offset seconds, for files with an
+// intro in front of the video's own content.
+func offsetChapters(chapters []database.Chapter, offset float64) []database.Chapter {
+	if offset == 0 {
+		return chapters
+	}
+	shifted := make([]database.Chapter, len(chapters))
+	for i, chapter := range chapters {
+		chapter.StartTime += offset
+		shifted[i] = chapter
+	}
+	return shifted
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Round(seconds*1000)) * time.Millisecond
+}
+
+// ffmetadataEscaper escapes the characters FFMETADATA files treat specially.
+var ffmetadataEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n")
+
+// buildChapterMetadata writes chapters in ffmpeg's FFMETADATA format, to be
+// muxed into an MP4. It returns nil if none of them fit in duration.
+func buildChapterMetadata(chapters []database.Chapter, duration float64) []byte {
+	cues := chapterCues(chapters, duration)
+	if len(cues) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	b.WriteString(";FFMETADATA1\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			cue.Start.Milliseconds(), cue.End.Milliseconds(), ffmetadataEscaper.Replace(cue.Text[0]))
+	}
+	return b.Bytes()
+}
+
+// getChaptersKey names a chapters track after its contents, like captions.
+func getChaptersKey(videoID uuid.UUID, data []byte) string {
+	return fmt.Sprintf("%schapters/%x.vtt", getVideoAssetPrefix(videoID), sha256.Sum256(data))
+}
+
+// getCurrentProbe returns the probe of a video's current file, or a zero
+// videoProbe if it has none.
+func (cfg *apiConfig) getCurrentProbe(video database.Video) (videoProbe, error) {
+	var probe videoProbe
+	if video.VideoURL == nil {
+		return probe, nil
+	}
+	key, ok := cfg.getObjectKey(*video.VideoURL)
+	if !ok {
+		return probe, nil
+	}
+	version, err := cfg.db.GetVideoVersionByKey(key)
+	if err != nil {
+		return probe, err
+	}
+	if len(version.Probe) > 0 {
+		if err := json.Unmarshal(version.Probe, &probe); err != nil {
+			return probe, fmt.Errorf("couldn't read version probe: %w", err)
+		}
+	}
+	return probe, nil
+}
+
+// getContentDuration is how long a video's own content is, leaving out any
+// intro and outro it was branded with, or 0 if it hasn't been probed.
+func (cfg *apiConfig) getContentDuration(video database.Video) (float64, error) {
+	if video.MediaInfo == nil {
+		return 0, nil
+	}
+	probe, err := cfg.getCurrentProbe(video)
+	if err != nil {
+		return 0, err
+	}
+	return max(0, video.MediaInfo.Duration-probe.ChapterOffset-probe.OutroLength), nil
+}
+
+// publishChapters writes a video's chapters as a WebVTT track for its
+// current file and points the video at it. The track is cleared when no
+// chapter fits in the file, or it hasn't been probed.
+func (cfg *apiConfig) publishChapters(ctx context.Context, videoID uuid.UUID) error {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return nil
+	}
+	chapters, err := cfg.db.GetChapters(videoID)
+	if err != nil {
+		return err
+	}
+
+	probe, err := cfg.getCurrentProbe(video)
+	if err != nil {
+		return err
+	}
+	chapters = offsetChapters(chapters, probe.ChapterOffset)
+
+	var chaptersURL *string
+	if video.MediaInfo != nil {
+		if cues := chapterCues(chapters, video.MediaInfo.Duration); len(cues) > 0 {
+			vtt := buildWebVTT(cues)
+			key := getChaptersKey(videoID, vtt)
+			err = cfg.storage.Put(ctx, key, bytes.NewReader(vtt), storage.PutOptions{
+				ContentType: "text/vtt",
+			})
+			if err != nil {
+				return fmt.Errorf("couldn't upload chapters: %w", err)
+			}
+			url := cfg.getObjectURL(key)
+			chaptersURL = &url
+		}
+	}
+
+	err = cfg.db.UpdateVideoChaptersURL(videoID, chaptersURL)
+	if err != nil {
+		return err
+	}
+
+	if video.ChaptersURL == nil || (chaptersURL != nil && *chaptersURL == *video.ChaptersURL) {
+		return nil
+	}
+	if key, ok := cfg.getObjectKey(*video.ChaptersURL); ok {
+		err = cfg.deleteStoredObjects(ctx, []database.CreatePendingDeletionParams{
+			{Store: deletionStoreStorage, Key: key},
+		})
+		if err != nil {
+			log.Printf("Couldn't delete chapters file %s: %v", key, err)
+		}
+	}
+	return nil
+}
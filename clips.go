@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// minClipLength is the shortest clip that can be cut, in seconds.
+const minClipLength = 1.0
+
+// clipCropRatios are the shapes a clip can be cropped to, by orientation, as
+// width and height.
+var clipCropRatios = map[string][2]int{
+	orientationLandscape: {16, 9},
+	orientationPortrait:  {9, 16},
+	orientationSquare:    {1, 1},
+}
+
+// createClipPayload describes the part of a source video a create_clip job
+// cuts out.
+type createClipPayload struct {
+	// SourceKey is the source's file when the clip was asked for, so the
+	// clip isn't affected by newer uploads
+	SourceKey string  `json:"source_key"`
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+	// Orientation, if set, crops the clip from the centre of the picture
+	Orientation string    `json:"orientation,omitempty"`
+	UploaderID  uuid.UUID `json:"uploader_id"`
+}
+
+// createClip cuts a clip out of its source video and stages it as an upload,
+// so it goes through the same processing as any other.
+func (cfg *apiConfig) createClip(ctx context.Context, clipID uuid.UUID, payload createClipPayload) error {
+	clip, err := cfg.db.GetVideo(clipID)
+	if err != nil {
+		return err
+	}
+	if clip.ID == uuid.Nil {
+		return nil
+	}
+
+	body, bodyInfo, err := cfg.storage.Get(ctx, payload.SourceKey)
+	if err != nil {
+		return fmt.Errorf("couldn't read source video: %w", err)
+	}
+	defer body.Close()
+
+	err = cfg.setProcessingStatus(clipID, database.ProcessingStatusProcessing, "")
+	if err != nil {
+		return err
+	}
+	progress := cfg.newVideoProgress(clipID)
+
+	tempFile, err := os.CreateTemp("", "tubely-clip-source.mp4")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	progress.startStage(progressStageDownloading)
+	_, err = io.Copy(tempFile, &progressReader{r: body, onRead: progress.byteProgress(bodyInfo.Size)})
+	if err != nil {
+		return fmt.Errorf("couldn't download source video: %w", err)
+	}
+
+	progress.startStage(progressStageTranscoding)
+	clipPath, err := cfg.renderClip(ctx, tempFile.Name(), payload, progress.update)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(clipPath)
+
+	clipFile, err := os.Open(clipPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open clip: %w", err)
+	}
+	defer clipFile.Close()
+
+	stagingKey, err := newStagingUploadKey(clipID)
+	if err != nil {
+		return err
+	}
+	err = cfg.storage.Put(ctx, stagingKey, clipFile, storage.PutOptions{ContentType: "video/mp4"})
+	if err != nil {
+		return fmt.Errorf("couldn't stage clip: %w", err)
+	}
+
+	_, err = cfg.enqueueUpload(clipID, processUploadPayload{
+		SourceKey:  stagingKey,
+		UploaderID: payload.UploaderID,
+		Derived:    true,
+	})
+	if err != nil {
+		if err := cfg.storage.Delete(ctx, stagingKey); err != nil {
+			log.Printf("Couldn't delete staged clip %s: %v", stagingKey, err)
+		}
+		return fmt.Errorf("couldn't queue clip for processing: %w", err)
+	}
+	return nil
+}
+
+// renderClip encodes the requested range of a video, cropping it if asked.
+// The source's chapters are dropped, since they don't line up with the clip.
+func (cfg *apiConfig) renderClip(ctx context.Context, sourcePath string, payload createClipPayload, onProgress func(fraction float64)) (string, error) {
+	length := payload.EndTime - payload.StartTime
+	outputPath := sourcePath + ".clip"
+	args := []string{
+		"-y",
+		"-ss", strconv.FormatFloat(payload.StartTime, 'f', 3, 64),
+		"-i", sourcePath,
+		"-t", strconv.FormatFloat(length, 'f', 3, 64),
+		"-map", "0:v:0", "-map", "0:a:0?", "-map_chapters", "-1",
+		"-vf", clipVideoFilter(payload.Orientation),
+		"-c:v", "libx264", "-preset", "medium", "-crf", "20", "-profile:v", "high",
+		"-c:a", "aac", "-b:a", "128k",
+		"-movflags", "+faststart", "-f", "mp4", outputPath,
+	}
+	err := cfg.runFFmpegWithProgress(ctx, time.Duration(length*float64(time.Second)), onProgress, args...)
+	if err != nil {
+		return "", fmt.Errorf("couldn't cut clip: %w", err)
+	}
+	return outputPath, nil
+}
+
+// clipVideoFilter builds the filters for a clip. Cropping first squares up
+// the pixels, so the crop has the right shape on screen, then takes the
+// largest centred rectangle of the orientation's ratio.
+func clipVideoFilter(orientation string) string {
+	ratio, ok := clipCropRatios[orientation]
+	if !ok {
+		return "scale=trunc(iw/2)*2:trunc(ih/2)*2,format=yuv420p"
+	}
+	w, h := ratio[0], ratio[1]
+	return fmt.Sprintf(
+		"scale=trunc(iw*sar/2)*2:trunc(ih/2)*2,setsar=1,crop='trunc(min(iw,ih*%d/%d)/2)*2':'trunc(min(ih,iw*%d/%d)/2)*2',format=yuv420p",
+		w, h, h, w,
+	)
+}
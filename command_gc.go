@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// gcPrefixes are the parts of the storage backend the garbage collector owns.
+var gcPrefixes = []string{
+	"landscape/",
+	"portrait/",
+	"square/",
+	"other/",
+	"thumbnails/",
+	"uploads/",
+	"videos/",
+}
+
+// commandGC finds stored objects that no video references any more and
+// deletes them, skipping anything newer than the grace period so uploads that
+// are still in flight are left alone.
+func (cfg *apiConfig) commandGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report orphaned objects")
+	grace := flags.Duration("grace", 24*time.Hour, "leave objects younger than this alone")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	refs, err := cfg.getMediaReferences()
+	if err != nil {
+		return fmt.Errorf("couldn't collect references: %w", err)
+	}
+
+	ctx := context.Background()
+	cutoff := time.Now().Add(-*grace)
+	orphans, reclaimed, failed := 0, int64(0), 0
+
+	sweep := func(storeName string, store storage.Store, prefix string) error {
+		objects, err := store.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("couldn't list %s%s: %w", storeName, prefix, err)
+		}
+		for _, obj := range objects {
+			if obj.LastModified.After(cutoff) || refs.isReferenced(storeName, obj.Key) {
+				continue
+			}
+
+			if *dryRun {
+				log.Printf("Orphaned: %s %s (%s)", storeName, obj.Key, formatBytes(obj.Size))
+			} else if err := store.Delete(ctx, obj.Key); err != nil {
+				log.Printf("Couldn't delete %s %s: %v", storeName, obj.Key, err)
+				failed++
+				continue
+			}
+			orphans++
+			reclaimed += obj.Size
+		}
+		return nil
+	}
+
+	for _, prefix := range gcPrefixes {
+		if err := sweep(deletionStoreStorage, cfg.storage, prefix); err != nil {
+			return err
+		}
+	}
+	if err := sweep(deletionStoreAssets, cfg.assets, ""); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		log.Printf("Found %d orphaned objects, %s could be reclaimed", orphans, formatBytes(reclaimed))
+		return nil
+	}
+	log.Printf("Deleted %d orphaned objects, reclaimed %s, %d failed", orphans, formatBytes(reclaimed), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d objects couldn't be deleted", failed)
+	}
+	return nil
+}
+
+// mediaReferences is everything in storage that the database still points at.
+type mediaReferences struct {
+	storage  map[string]bool
+	assets   map[string]bool
+	videoIDs map[uuid.UUID]bool
+}
+
+func (cfg *apiConfig) getMediaReferences() (mediaReferences, error) {
+	refs := mediaReferences{
+		storage:  map[string]bool{},
+		assets:   map[string]bool{},
+		videoIDs: map[uuid.UUID]bool{},
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return refs, err
+	}
+	for _, video := range videos {
+		refs.videoIDs[video.ID] = true
+		for _, u := range []*string{video.VideoURL, video.ThumbnailURL} {
+			if u == nil {
+				continue
+			}
+			if key, ok := cfg.getObjectKey(*u); ok {
+				refs.storage[key] = true
+			} else if assetName, ok := getLocalAssetName(*u); ok {
+				refs.assets[assetName] = true
+			}
+		}
+	}
+
+	// Deduplicated files are kept for as long as their blob record exists, and
+	// old versions for as long as they can be restored
+	blobKeys, err := cfg.db.GetBlobKeys()
+	if err != nil {
+		return refs, err
+	}
+	versionKeys, err := cfg.db.GetVideoVersionKeys()
+	if err != nil {
+		return refs, err
+	}
+	for _, key := range append(blobKeys, versionKeys...) {
+		refs.storage[key] = true
+	}
+	return refs, nil
+}
+
+func (refs mediaReferences) isReferenced(storeName, key string) bool {
+	if storeName == deletionStoreAssets {
+		return refs.assets[key]
+	}
+	if refs.storage[key] {
+		return true
+	}
+
+	// Everything under a video's asset prefix lives as long as the video does
+	if rest, ok := strings.CutPrefix(key, "videos/"); ok {
+		idString, _, _ := strings.Cut(rest, "/")
+		if id, err := uuid.Parse(idString); err == nil {
+			return refs.videoIDs[id]
+		}
+	}
+	return false
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"path"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// commandMigrateThumbnails copies thumbnails still living in assetsRoot into
+// the storage backend and repoints the videos at their new URLs.
+func (cfg *apiConfig) commandMigrateThumbnails(args []string) error {
+	flags := flag.NewFlagSet("migrate-thumbnails", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be migrated")
+	keepLocal := flags.Bool("keep-local", false, "don't delete local files once migrated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return fmt.Errorf("couldn't get videos: %w", err)
+	}
+
+	ctx := context.Background()
+	migrated, failed := 0, 0
+	for _, video := range videos {
+		if video.ThumbnailURL == nil {
+			continue
+		}
+		assetName, ok := getLocalAssetName(*video.ThumbnailURL)
+		if !ok {
+			continue
+		}
+
+		if *dryRun {
+			log.Printf("Would migrate %s for video %s", assetName, video.ID)
+			migrated++
+			continue
+		}
+
+		err := cfg.migrateThumbnail(ctx, video, assetName, *keepLocal)
+		if err != nil {
+			log.Printf("Couldn't migrate %s for video %s: %v", assetName, video.ID, err)
+			failed++
+			continue
+		}
+		migrated++
+	}
+
+	if *dryRun {
+		log.Printf("Found %d thumbnails to migrate", migrated)
+		return nil
+	}
+	log.Printf("Migrated %d thumbnails, %d failed", migrated, failed)
+	if failed > 0 {
+		return errors.New("some thumbnails couldn't be migrated")
+	}
+	return nil
+}
+
+func (cfg *apiConfig) migrateThumbnail(ctx context.Context, video database.Video, assetName string, keepLocal bool) error {
+	body, info, err := cfg.assets.Get(ctx, assetName)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	mediaType := info.ContentType
+	if mediaType == "" {
+		mediaType = mime.TypeByExtension(path.Ext(assetName))
+	}
+	thumbnailKey := getThumbnailKey(video.ID, data, mediaType)
+
+	err = cfg.storage.Put(ctx, thumbnailKey, bytes.NewReader(data), storage.PutOptions{
+		ContentType: mediaType,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only the thumbnail is written, since the server may be changing the
+	// rest of the video meanwhile
+	err = cfg.db.UpdateVideoThumbnailURL(video.ID, cfg.getObjectURL(thumbnailKey))
+	if err != nil {
+		return err
+	}
+
+	if keepLocal {
+		return nil
+	}
+	return cfg.assets.Delete(ctx, assetName)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// videoObjectPrefixes are where processed videos are stored, by orientation.
+// other/ held everything that wasn't exactly 16:9 or 9:16 before videos were
+// classified properly.
+var videoObjectPrefixes = []string{
+	orientationLandscape + "/",
+	orientationPortrait + "/",
+	orientationSquare + "/",
+	"other/",
+}
+
+// commandReprocess probes every stored video file again, refreshing its probe
+// data and moving it under a new orientation prefix if its classification
+// has changed.
+func (cfg *apiConfig) commandReprocess(args []string) error {
+	flags := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report files that would move")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return fmt.Errorf("couldn't get videos: %w", err)
+	}
+	keys, err := cfg.getVideoObjectKeys(videos)
+	if err != nil {
+		return fmt.Errorf("couldn't collect video files: %w", err)
+	}
+
+	ctx := context.Background()
+	moved, unchanged, failed := 0, 0, 0
+	for _, key := range keys {
+		newKey, err := cfg.reprocessVideoObject(ctx, key, videos, *dryRun)
+		if err != nil {
+			log.Printf("Couldn't reprocess %s: %v", key, err)
+			failed++
+			continue
+		}
+		if newKey == key {
+			unchanged++
+			continue
+		}
+		if *dryRun {
+			log.Printf("Would move %s to %s", key, newKey)
+		} else {
+			log.Printf("Moved %s to %s", key, newKey)
+		}
+		moved++
+	}
+
+	if *dryRun {
+		log.Printf("Found %d files to move, %d unchanged, %d failed", moved, unchanged, failed)
+	} else {
+		log.Printf("Moved %d files, %d unchanged, %d failed", moved, unchanged, failed)
+	}
+	if failed > 0 {
+		return errors.New("some files couldn't be reprocessed")
+	}
+	return nil
+}
+
+// getVideoObjectKeys returns every processed video file the database knows
+// about, whether it's current, an old version or only a blob.
+func (cfg *apiConfig) getVideoObjectKeys(videos []database.Video) ([]string, error) {
+	seen := map[string]bool{}
+	for _, video := range videos {
+		if video.VideoURL == nil {
+			continue
+		}
+		if key, ok := cfg.getObjectKey(*video.VideoURL); ok {
+			seen[key] = true
+		}
+	}
+
+	versionKeys, err := cfg.db.GetVideoVersionKeys()
+	if err != nil {
+		return nil, err
+	}
+	blobKeys, err := cfg.db.GetBlobKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range append(versionKeys, blobKeys...) {
+		seen[key] = true
+	}
+
+	keys := []string{}
+	for key := range seen {
+		for _, prefix := range videoObjectPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// reprocessVideoObject probes one stored video file and returns the key it
+// belongs under. Unless dryRun is set the file is moved there and the probe
+// data of its versions and videos is brought up to date.
+func (cfg *apiConfig) reprocessVideoObject(ctx context.Context, key string, videos []database.Video, dryRun bool) (string, error) {
+	workDir, err := os.MkdirTemp("", "tubely-reprocess-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(workDir)
+
+	localPath := filepath.Join(workDir, "video.mp4")
+	err = cfg.downloadObject(ctx, key, localPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't download: %w", err)
+	}
+	info, err := cfg.probeMedia(ctx, localPath)
+	if err != nil {
+		return "", err
+	}
+
+	newKey := info.Orientation + "/" + path.Base(key)
+	if dryRun {
+		return newKey, nil
+	}
+
+	if newKey != key {
+		f, err := os.Open(localPath)
+		if err != nil {
+			return "", err
+		}
+		err = cfg.storage.Put(ctx, newKey, f, storage.PutOptions{ContentType: "video/mp4"})
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("couldn't copy to %s: %w", newKey, err)
+		}
+
+		err = cfg.db.RenameVideoObject(key, newKey, cfg.getObjectURL(key), cfg.getObjectURL(newKey))
+		if err != nil {
+			cfg.storage.Delete(ctx, newKey)
+			return "", fmt.Errorf("couldn't update references: %w", err)
+		}
+
+		err = cfg.deleteStoredObjects(ctx, []database.CreatePendingDeletionParams{
+			{Store: deletionStoreStorage, Key: key},
+		})
+		if err != nil {
+			log.Printf("Couldn't delete %s after moving it: %v", key, err)
+		}
+	}
+
+	// Keep what can't be probed from the file, like the intro's length
+	var probe videoProbe
+	version, err := cfg.db.GetVideoVersionByKey(newKey)
+	if err != nil {
+		return "", err
+	}
+	if len(version.Probe) > 0 {
+		if err := json.Unmarshal(version.Probe, &probe); err != nil {
+			return "", fmt.Errorf("couldn't read version probe: %w", err)
+		}
+	}
+	probe.AspectRatio = info.AspectRatio
+	probe.MediaInfo = &info
+	probeData, err := json.Marshal(probe)
+	if err != nil {
+		return "", err
+	}
+	err = cfg.db.UpdateVideoVersionProbes(newKey, probeData)
+	if err != nil {
+		return "", fmt.Errorf("couldn't update versions: %w", err)
+	}
+
+	oldURL := cfg.getObjectURL(key)
+	for _, video := range videos {
+		if video.VideoURL == nil || *video.VideoURL != oldURL {
+			continue
+		}
+		err = cfg.db.UpdateVideoMediaInfo(video.ID, &info)
+		if err != nil {
+			return "", fmt.Errorf("couldn't update video %s: %w", video.ID, err)
+		}
+	}
+	return newKey, nil
+}
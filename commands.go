@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+// runCommand runs a one-off maintenance command instead of starting the
+// server, e.g. `go run . migrate-thumbnails -dry-run`.
+func (cfg *apiConfig) runCommand(name string, args []string) error {
+	switch name {
+	case "gc":
+		return cfg.commandGC(args)
+	case "migrate-thumbnails":
+		return cfg.commandMigrateThumbnails(args)
+	case "reprocess":
+		return cfg.commandReprocess(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
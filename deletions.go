@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	deletionStoreStorage = "storage"
+	deletionStoreAssets  = "assets"
+
+	deletionSweepInterval = time.Minute
+	deletionSweepBatch    = 100
+	deletionMaxBackoff    = 6 * time.Hour
+)
+
+// deleteVideo deletes a video and every object it owns, including the files
+// of all its versions, its captions and chapters, and the data of its
+// unfinished tus uploads. The objects' deletions are recorded along with the
+// video's row (see database.Client.DeleteVideo), and anything that fails to
+// go now gets retried by sweepPendingDeletions.
+func (cfg *apiConfig) deleteVideo(ctx context.Context, video database.Video, versions []database.VideoVersion) error {
+	objects := []database.CreatePendingDeletionParams{
+		{Store: deletionStoreStorage, Key: getThumbnailPrefix(video.ID), Prefix: true},
+		{Store: deletionStoreStorage, Key: stagingUploadPrefix(video.ID), Prefix: true},
+		{Store: deletionStoreStorage, Key: getVideoAssetPrefix(video.ID), Prefix: true},
+	}
+	if video.ThumbnailURL != nil {
+		if assetName, ok := getLocalAssetName(*video.ThumbnailURL); ok {
+			objects = append(objects, database.CreatePendingDeletionParams{
+				Store: deletionStoreAssets,
+				Key:   assetName,
+			})
+		}
+	}
+
+	// Video files may be shared with other videos, so each version only gives
+	// up its own reference
+	videoFiles := []database.CreatePendingDeletionParams{}
+	versionKeys := map[string]bool{}
+	for _, version := range versions {
+		versionKeys[version.Key] = true
+		videoFiles = append(videoFiles, database.CreatePendingDeletionParams{Store: deletionStoreStorage, Key: version.Key})
+	}
+	if video.VideoURL != nil {
+		if key, ok := cfg.getObjectKey(*video.VideoURL); ok && !versionKeys[key] {
+			videoFiles = append(videoFiles, database.CreatePendingDeletionParams{Store: deletionStoreStorage, Key: key})
+		}
+	}
+
+	pending, uploadIDs, err := cfg.db.DeleteVideo(video.ID, objects, videoFiles)
+	if err != nil {
+		return err
+	}
+	for _, deletion := range pending {
+		cfg.attemptPendingDeletion(ctx, deletion)
+	}
+	for _, id := range uploadIDs {
+		err := os.Remove(cfg.uploadDiskPath(id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Couldn't remove upload %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// deleteStoredObjects records each target as a pending deletion and then
+// tries to delete it straight away.
+func (cfg *apiConfig) deleteStoredObjects(ctx context.Context, targets []database.CreatePendingDeletionParams) error {
+	pending := []database.PendingDeletion{}
+	for _, target := range targets {
+		deletion, err := cfg.db.CreatePendingDeletion(target)
+		if err != nil {
+			return fmt.Errorf("couldn't record deletion of %s: %w", target.Key, err)
+		}
+		pending = append(pending, deletion)
+	}
+
+	for _, deletion := range pending {
+		cfg.attemptPendingDeletion(ctx, deletion)
+	}
+	return nil
+}
+
+// sweepPendingDeletions retries failed deletions until ctx is cancelled.
+func (cfg *apiConfig) sweepPendingDeletions(ctx context.Context) {
+	ticker := time.NewTicker(deletionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		deletions, err := cfg.db.GetDuePendingDeletions(time.Now().UTC(), deletionSweepBatch)
+		if err != nil {
+			log.Printf("Couldn't list pending deletions: %v", err)
+		}
+		for _, deletion := range deletions {
+			cfg.attemptPendingDeletion(ctx, deletion)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) attemptPendingDeletion(ctx context.Context, deletion database.PendingDeletion) {
+	err := cfg.deleteObjects(ctx, deletion)
+	if err == nil {
+		err = cfg.db.DeletePendingDeletion(deletion.ID)
+		if err != nil {
+			log.Printf("Couldn't clear pending deletion %s: %v", deletion.ID, err)
+		}
+		return
+	}
+
+	// Back off exponentially so a broken key doesn't hammer the backend
+	backoff := deletionSweepInterval << min(deletion.Attempts, 10)
+	backoff = min(backoff, deletionMaxBackoff)
+	log.Printf("Couldn't delete %s (attempt %d), retrying in %s: %v", deletion.Key, deletion.Attempts+1, backoff, err)
+
+	err = cfg.db.MarkPendingDeletionFailed(deletion.ID, err.Error(), time.Now().UTC().Add(backoff))
+	if err != nil {
+		log.Printf("Couldn't record failed deletion %s: %v", deletion.ID, err)
+	}
+}
+
+func (cfg *apiConfig) deleteObjects(ctx context.Context, deletion database.PendingDeletion) error {
+	store := cfg.storage
+	if deletion.Store == deletionStoreAssets {
+		store = cfg.assets
+	}
+
+	if !deletion.Prefix {
+		return store.Delete(ctx, deletion.Key)
+	}
+
+	objects, err := store.List(ctx, deletion.Key)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		err := store.Delete(ctx, obj.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
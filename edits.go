@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	editRotate = "rotate"
+	editCrop   = "crop"
+	editMute   = "mute"
+	editSpeed  = "speed"
+	editVolume = "volume"
+
+	maxEditOperations = 20
+	minEditSpeed      = 0.25
+	maxEditSpeed      = 4.0
+	maxEditVolume     = 4
+	// minEditCropSize is the smallest crop, in pixels on either side
+	minEditCropSize = 16
+)
+
+// editOperation is one step in a video's list of edits. Which fields are used
+// depends on the Type.
+type editOperation struct {
+	Type string `json:"type"`
+	// Degrees turns the picture clockwise, by 90, 180 or 270
+	Degrees int `json:"degrees,omitempty"`
+	// X, Y, Width and Height are a crop rectangle in pixels, measured on the
+	// picture as the edits before it leave it
+	X      int `json:"x,omitempty"`
+	Y      int `json:"y,omitempty"`
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Factor multiplies the speed or volume
+	Factor float64 `json:"factor,omitempty"`
+}
+
+// renderEditsPayload points a render_edits job at the version to edit.
+type renderEditsPayload struct {
+	SourceVersionID uuid.UUID       `json:"source_version_id"`
+	Operations      []editOperation `json:"operations"`
+	UploaderID      uuid.UUID       `json:"uploader_id"`
+}
+
+// normalizeEdits checks a list of edits against the video they'll be applied
+// to, in order. Crops are rounded down to even sizes, which H.264 needs.
+func normalizeEdits(operations []editOperation, info database.MediaInfo) ([]editOperation, error) {
+	if len(operations) > maxEditOperations {
+		return nil, fmt.Errorf("no more than %d edits can be made", maxEditOperations)
+	}
+
+	width, height := displaySize(info)
+	hasAudio := info.AudioCodec != ""
+	normalized := make([]editOperation, 0, len(operations))
+	for i, op := range operations {
+		switch op.Type {
+		case editRotate:
+			degrees := (op.Degrees%360 + 360) % 360
+			if degrees == 0 || degrees%90 != 0 {
+				return nil, fmt.Errorf("edit %d: rotate degrees must be 90, 180 or 270", i+1)
+			}
+			if degrees != 180 {
+				width, height = height, width
+			}
+			op = editOperation{Type: editRotate, Degrees: degrees}
+		case editCrop:
+			op = editOperation{Type: editCrop, X: op.X, Y: op.Y, Width: op.Width / 2 * 2, Height: op.Height / 2 * 2}
+			if op.Width < minEditCropSize || op.Height < minEditCropSize {
+				return nil, fmt.Errorf("edit %d: crop must be at least %dx%d", i+1, minEditCropSize, minEditCropSize)
+			}
+			if op.X < 0 || op.Y < 0 || op.X+op.Width > width || op.Y+op.Height > height {
+				return nil, fmt.Errorf("edit %d: crop must fit in the %dx%d picture", i+1, width, height)
+			}
+			width, height = op.Width, op.Height
+		case editMute:
+			op = editOperation{Type: editMute}
+			hasAudio = false
+		case editSpeed:
+			if op.Factor < minEditSpeed || op.Factor > maxEditSpeed {
+				return nil, fmt.Errorf("edit %d: speed factor must be between %g and %g", i+1, minEditSpeed, maxEditSpeed)
+			}
+			op = editOperation{Type: editSpeed, Factor: op.Factor}
+		case editVolume:
+			if !hasAudio {
+				return nil, fmt.Errorf("edit %d: there's no audio to change the volume of", i+1)
+			}
+			if op.Factor < 0 || op.Factor > maxEditVolume {
+				return nil, fmt.Errorf("edit %d: volume factor must be between 0 and %d", i+1, maxEditVolume)
+			}
+			op = editOperation{Type: editVolume, Factor: op.Factor}
+		default:
+			return nil, fmt.Errorf("edit %d: unknown type %q, expected rotate, crop, mute, speed or volume", i+1, op.Type)
+		}
+		normalized = append(normalized, op)
+	}
+	return normalized, nil
+}
+
+// buildEditFilters turns a list of edits into ffmpeg filter chains, and
+// reports whether the audio should be dropped. speed is the overall change
+// in playback speed.
+func buildEditFilters(operations []editOperation) (videoFilter, audioFilter string, mute bool, speed float64) {
+	// Square up the pixels first, so crops are measured on the picture as
+	// it's shown
+	video := []string{"scale=trunc(iw*sar/2)*2:trunc(ih/2)*2", "setsar=1"}
+	audio := []string{}
+	speed = 1
+	for _, op := range operations {
+		switch op.Type {
+		case editRotate:
+			switch op.Degrees {
+			case 90:
+				video = append(video, "transpose=clock")
+			case 180:
+				video = append(video, "hflip", "vflip")
+			case 270:
+				video = append(video, "transpose=cclock")
+			}
+		case editCrop:
+			video = append(video, fmt.Sprintf("crop=%d:%d:%d:%d", op.Width, op.Height, op.X, op.Y))
+		case editMute:
+			mute = true
+		case editSpeed:
+			speed *= op.Factor
+			video = append(video, fmt.Sprintf("setpts=PTS/%g", op.Factor))
+			audio = append(audio, atempoFilters(op.Factor)...)
+		case editVolume:
+			audio = append(audio, fmt.Sprintf("volume=%g", op.Factor))
+		}
+	}
+	video = append(video, "format=yuv420p")
+	return strings.Join(video, ","), strings.Join(audio, ","), mute, speed
+}
+
+// editSpeedFactor is the overall change in playback speed a list of edits
+// makes.
+func editSpeedFactor(operations []editOperation) float64 {
+	_, _, _, speed := buildEditFilters(operations)
+	return speed
+}
+
+// atempoFilters changes the audio tempo by factor, chaining filters since
+// each atempo only goes from half to double speed.
+func atempoFilters(factor float64) []string {
+	filters := []string{}
+	for factor > 2 {
+		filters = append(filters, "atempo=2")
+		factor /= 2
+	}
+	for factor < 0.5 {
+		filters = append(filters, "atempo=0.5")
+		factor /= 0.5
+	}
+	return append(filters, fmt.Sprintf("atempo=%g", factor))
+}
+
+// getEditVersions finds a video's current version and the original it was
+// edited from, which is the current version itself if it hasn't been edited.
+// ok is false if the current file isn't a recorded version.
+func (cfg *apiConfig) getEditVersions(video database.Video) (current, original database.VideoVersion, ok bool, err error) {
+	if video.VideoURL == nil {
+		return database.VideoVersion{}, database.VideoVersion{}, false, nil
+	}
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return database.VideoVersion{}, database.VideoVersion{}, false, err
+	}
+	for _, version := range versions {
+		if cfg.getObjectURL(version.Key) == *video.VideoURL {
+			current = version
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return database.VideoVersion{}, database.VideoVersion{}, false, nil
+	}
+	if current.EditedFromID == nil {
+		return current, current, true, nil
+	}
+
+	original, err = cfg.db.GetVideoVersion(*current.EditedFromID)
+	if err != nil {
+		return database.VideoVersion{}, database.VideoVersion{}, false, err
+	}
+	if original.VideoID != video.ID {
+		return database.VideoVersion{}, database.VideoVersion{}, false, errors.New("edited version's original is missing")
+	}
+	return current, original, true, nil
+}
+
+// renderEdits applies a list of edits to a version and stages the result as
+// an upload, so it's processed and published as a new version like any other.
+// The version it was rendered from is left as it is.
+func (cfg *apiConfig) renderEdits(ctx context.Context, videoID uuid.UUID, payload renderEditsPayload) error {
+	source, err := cfg.db.GetVideoVersion(payload.SourceVersionID)
+	if err != nil {
+		return err
+	}
+	if source.VideoID != videoID {
+		// The video was deleted, along with its versions
+		return nil
+	}
+	var probe videoProbe
+	if err := json.Unmarshal(source.Probe, &probe); err != nil {
+		return fmt.Errorf("couldn't read version probe: %w", err)
+	}
+	edits, err := json.Marshal(payload.Operations)
+	if err != nil {
+		return err
+	}
+
+	body, bodyInfo, err := cfg.storage.Get(ctx, source.Key)
+	if err != nil {
+		return fmt.Errorf("couldn't read original video: %w", err)
+	}
+	defer body.Close()
+
+	err = cfg.setProcessingStatus(videoID, database.ProcessingStatusProcessing, "")
+	if err != nil {
+		return err
+	}
+	progress := cfg.newVideoProgress(videoID)
+
+	tempFile, err := os.CreateTemp("", "tubely-edit-source.mp4")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	progress.startStage(progressStageDownloading)
+	_, err = io.Copy(tempFile, &progressReader{r: body, onRead: progress.byteProgress(bodyInfo.Size)})
+	if err != nil {
+		return fmt.Errorf("couldn't download original video: %w", err)
+	}
+
+	var duration float64
+	if probe.MediaInfo != nil {
+		duration = probe.MediaInfo.Duration
+	}
+	progress.startStage(progressStageTranscoding)
+	editedPath, err := cfg.applyEdits(ctx, tempFile.Name(), payload.Operations, duration, progress.update)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(editedPath)
+
+	editedFile, err := os.Open(editedPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open edited video: %w", err)
+	}
+	defer editedFile.Close()
+
+	stagingKey, err := newStagingUploadKey(videoID)
+	if err != nil {
+		return err
+	}
+	err = cfg.storage.Put(ctx, stagingKey, editedFile, storage.PutOptions{ContentType: "video/mp4"})
+	if err != nil {
+		return fmt.Errorf("couldn't stage edited video: %w", err)
+	}
+
+	_, err = cfg.enqueueUpload(videoID, processUploadPayload{
+		SourceKey:    stagingKey,
+		UploaderID:   payload.UploaderID,
+		EditedFromID: &source.ID,
+		Edits:        edits,
+		Derived:      true,
+		// The intro and outro, if the original has them, are sped up along
+		// with the rest
+		ChapterOffset: probe.ChapterOffset / editSpeedFactor(payload.Operations),
+		OutroLength:   probe.OutroLength / editSpeedFactor(payload.Operations),
+	})
+	if err != nil {
+		if err := cfg.storage.Delete(ctx, stagingKey); err != nil {
+			log.Printf("Couldn't delete staged edit %s: %v", stagingKey, err)
+		}
+		return fmt.Errorf("couldn't queue edited video for processing: %w", err)
+	}
+	return nil
+}
+
+// applyEdits renders a video with a list of edits. Embedded chapters are
+// dropped, since speed changes move them; the video's own chapters are
+// written back when the result is processed.
+func (cfg *apiConfig) applyEdits(ctx context.Context, sourcePath string, operations []editOperation, duration float64, onProgress func(fraction float64)) (string, error) {
+	videoFilter, audioFilter, mute, speed := buildEditFilters(operations)
+	outputPath := sourcePath + ".edited"
+	args := []string{
+		"-y", "-i", sourcePath,
+		"-map", "0:v:0", "-map_chapters", "-1",
+		"-vf", videoFilter,
+		"-c:v", "libx264", "-preset", "medium", "-crf", "20", "-profile:v", "high",
+	}
+	if mute {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-map", "0:a:0?")
+		if audioFilter != "" {
+			args = append(args, "-af", audioFilter)
+		}
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args, "-movflags", "+faststart", "-f", "mp4", outputPath)
+
+	err := cfg.runFFmpegWithProgress(ctx, time.Duration(duration/speed*float64(time.Second)), onProgress, args...)
+	if err != nil {
+		return "", fmt.Errorf("couldn't render edits: %w", err)
+	}
+	return outputPath, nil
+}
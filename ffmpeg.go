@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+// probeTimeout limits a single ffprobe run, which only reads headers and
+// should never take long.
+const probeTimeout = time.Minute
+
+// runFFmpeg runs ffmpeg quietly, so a failure's *ffmpeg.Error carries only
+// the error messages.
+func (cfg *apiConfig) runFFmpeg(ctx context.Context, args ...string) error {
+	return cfg.ffmpeg.Run(ctx, ffmpeg.Command{
+		Program: "ffmpeg",
+		Args:    append([]string{"-hide_banner", "-loglevel", "error"}, args...),
+	})
+}
+
+// runFFmpegWithProgress is runFFmpeg for commands whose output lasts
+// duration, calling onProgress with how far through it ffmpeg has got.
+func (cfg *apiConfig) runFFmpegWithProgress(ctx context.Context, duration time.Duration, onProgress func(fraction float64), args ...string) error {
+	return cfg.ffmpeg.Run(ctx, ffmpeg.Command{
+		Program: "ffmpeg",
+		Args:    append([]string{"-hide_banner", "-loglevel", "error", "-nostats", "-progress", "pipe:1"}, args...),
+		Stdout: &ffmpeg.ProgressWriter{
+			Duration:   duration,
+			OnProgress: onProgress,
+		},
+	})
+}
+
+// runFFprobe runs `ffprobe -show_format -show_streams` over a file.
+func (cfg *apiConfig) runFFprobe(ctx context.Context, filePath string) (ffprobeOutput, error) {
+	var stdout bytes.Buffer
+	err := cfg.ffmpeg.Run(ctx, ffmpeg.Command{
+		Program: "ffprobe",
+		Args: []string{
+			"-v", "error",
+			"-show_format",
+			"-show_streams",
+			"-print_format", "json",
+			filePath,
+		},
+		Timeout: probeTimeout,
+		Stdout:  &stdout,
+	})
+	if err != nil {
+		return ffprobeOutput{}, err
+	}
+
+	var output ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return ffprobeOutput{}, fmt.Errorf("couldn't parse ffprobe output: %w", err)
+	}
+	return output, nil
+}
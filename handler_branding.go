@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// brandingResponse is a user's branding, with URLs for its files.
+type brandingResponse struct {
+	database.Branding
+	WatermarkURL *string `json:"watermark_url"`
+	IntroURL     *string `json:"intro_url"`
+	OutroURL     *string `json:"outro_url"`
+}
+
+func (cfg *apiConfig) newBrandingResponse(branding database.Branding) brandingResponse {
+	response := brandingResponse{Branding: branding}
+	objectURL := func(key *string) *string {
+		if key == nil {
+			return nil
+		}
+		url := cfg.getObjectURL(*key)
+		return &url
+	}
+	if branding.Watermark != nil {
+		response.WatermarkURL = objectURL(&branding.Watermark.Key)
+	}
+	response.IntroURL = objectURL(branding.IntroKey)
+	response.OutroURL = objectURL(branding.OutroKey)
+	return response
+}
+
+// authenticateBranding finds the user whose branding a request is for,
+// responding with the problem if there is one.
+func (cfg *apiConfig) authenticateBranding(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// respondWithBranding responds with a user's branding as it is now.
+func (cfg *apiConfig) respondWithBranding(w http.ResponseWriter, userID uuid.UUID) {
+	branding, err := cfg.db.GetBranding(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get branding", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, cfg.newBrandingResponse(branding))
+}
+
+// deleteReplacedBrandingFile deletes a branding file that's been replaced or
+// removed. Uploads already being processed with it will fail and be retried
+// with the new branding.
+func (cfg *apiConfig) deleteReplacedBrandingFile(ctx context.Context, oldKey *string, newKey string) {
+	if oldKey == nil || *oldKey == newKey {
+		return
+	}
+	err := cfg.deleteStoredObjects(ctx, []database.CreatePendingDeletionParams{
+		{Store: deletionStoreStorage, Key: *oldKey},
+	})
+	if err != nil {
+		log.Printf("Couldn't delete branding file %s: %v", *oldKey, err)
+	}
+}
+
+func (cfg *apiConfig) handlerBrandingGet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateBranding(w, r)
+	if !ok {
+		return
+	}
+	cfg.respondWithBranding(w, userID)
+}
+
+// handlerBrandingWatermarkUpdate sets the watermark put on the caller's
+// uploads. The image can be left out to only change how an existing one is
+// placed, and settings that are left out keep their current values.
+func (cfg *apiConfig) handlerBrandingWatermarkUpdate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateBranding(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxWatermarkSize+1<<20)
+	err := r.ParseMultipartForm(maxWatermarkSize)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+		return
+	}
+
+	branding, err := cfg.db.GetBranding(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get branding", err)
+		return
+	}
+	watermark := database.Watermark{
+		Position: defaultWatermarkPosition,
+		Opacity:  defaultWatermarkOpacity,
+		Scale:    defaultWatermarkScale,
+	}
+	if branding.Watermark != nil {
+		watermark = *branding.Watermark
+	}
+
+	if position := r.FormValue("position"); position != "" {
+		if !slices.Contains(watermarkPositions, position) {
+			respondWithError(w, http.StatusBadRequest, "Position must be top-left, top-right, bottom-left, bottom-right or center", nil)
+			return
+		}
+		watermark.Position = position
+	}
+	if opacity := r.FormValue("opacity"); opacity != "" {
+		watermark.Opacity, err = strconv.ParseFloat(opacity, 64)
+		if err != nil || watermark.Opacity <= 0 || watermark.Opacity > 1 {
+			respondWithError(w, http.StatusBadRequest, "Opacity must be a number above 0, up to 1", err)
+			return
+		}
+	}
+	if scale := r.FormValue("scale"); scale != "" {
+		watermark.Scale, err = strconv.ParseFloat(scale, 64)
+		if err != nil || watermark.Scale <= 0 || watermark.Scale > 1 {
+			respondWithError(w, http.StatusBadRequest, "Scale must be a number above 0, up to 1", err)
+			return
+		}
+	}
+
+	file, header, err := r.FormFile("watermark")
+	switch {
+	case err == http.ErrMissingFile:
+		if branding.Watermark == nil {
+			respondWithError(w, http.StatusBadRequest, "No watermark image given", nil)
+			return
+		}
+	case err != nil:
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	default:
+		defer file.Close()
+		mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+		if err != nil || (mediaType != "image/png" && mediaType != "image/jpeg") {
+			respondWithError(w, http.StatusBadRequest, "Watermark must be a PNG or JPEG image", err)
+			return
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error reading file", err)
+			return
+		}
+		sum := sha256.Sum256(data)
+		watermark.Key = getBrandingKey(userID, "watermark", sum[:], mediaType)
+		err = cfg.storage.Put(r.Context(), watermark.Key, bytes.NewReader(data), storage.PutOptions{
+			ContentType: mediaType,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't upload watermark", err)
+			return
+		}
+	}
+
+	err = cfg.db.SetBrandingWatermark(userID, &watermark)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update branding", err)
+		return
+	}
+	if branding.Watermark != nil {
+		cfg.deleteReplacedBrandingFile(r.Context(), &branding.Watermark.Key, watermark.Key)
+	}
+	cfg.respondWithBranding(w, userID)
+}
+
+func (cfg *apiConfig) handlerBrandingWatermarkDelete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateBranding(w, r)
+	if !ok {
+		return
+	}
+
+	branding, err := cfg.db.GetBranding(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get branding", err)
+		return
+	}
+	if branding.Watermark == nil {
+		respondWithError(w, http.StatusNotFound, "No watermark set", nil)
+		return
+	}
+
+	err = cfg.db.SetBrandingWatermark(userID, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update branding", err)
+		return
+	}
+	cfg.deleteReplacedBrandingFile(r.Context(), &branding.Watermark.Key, "")
+	cfg.respondWithBranding(w, userID)
+}
+
+// brandingBumper picks out the intro or outro a request is for, responding
+// with a 404 for anything else.
+func brandingBumper(w http.ResponseWriter, r *http.Request, branding database.Branding) (key *string, set func(database.Client, uuid.UUID, *string) error, ok bool) {
+	switch r.PathValue("bumper") {
+	case "intro":
+		return branding.IntroKey, database.Client.SetBrandingIntro, true
+	case "outro":
+		return branding.OutroKey, database.Client.SetBrandingOutro, true
+	default:
+		respondWithError(w, http.StatusNotFound, "Not found", nil)
+		return nil, nil, false
+	}
+}
+
+// handlerBrandingBumperUpdate sets the intro or outro played around the
+// caller's uploads. It's checked with ffprobe before it's accepted, so a
+// bad file can't break every upload after it.
+func (cfg *apiConfig) handlerBrandingBumperUpdate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateBranding(w, r)
+	if !ok {
+		return
+	}
+	branding, err := cfg.db.GetBranding(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get branding", err)
+		return
+	}
+	oldKey, setBumper, ok := brandingBumper(w, r, branding)
+	if !ok {
+		return
+	}
+	name := r.PathValue("bumper")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBumperSize)
+	const maxMemory = 32 << 20
+	err = r.ParseMultipartForm(maxMemory)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+		return
+	}
+	file, header, err := r.FormFile("video")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil || !cfg.uploadContentTypes.allows(mediaType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type, expected one of "+cfg.uploadContentTypes.String(), err)
+		return
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-bumper")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file", err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(tempFile, io.TeeReader(file, hasher))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error reading file", err)
+		return
+	}
+
+	probe, err := cfg.runFFprobe(r.Context(), tempFile.Name())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read video", err)
+		return
+	}
+	if _, ok := probe.videoStream(); !ok {
+		respondWithError(w, http.StatusBadRequest, "File has no video stream", nil)
+		return
+	}
+	duration, _ := strconv.ParseFloat(probe.Format.Duration, 64)
+	if duration <= 0 || duration > maxBumperDuration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("The %s must be no more than %d seconds long", name, maxBumperDuration), nil)
+		return
+	}
+
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error reading file", err)
+		return
+	}
+	key := getBrandingKey(userID, name, hasher.Sum(nil), mediaType)
+	err = cfg.storage.Put(r.Context(), key, tempFile, storage.PutOptions{ContentType: mediaType})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't upload "+name, err)
+		return
+	}
+
+	err = setBumper(cfg.db, userID, &key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update branding", err)
+		return
+	}
+	cfg.deleteReplacedBrandingFile(r.Context(), oldKey, key)
+	cfg.respondWithBranding(w, userID)
+}
+
+func (cfg *apiConfig) handlerBrandingBumperDelete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateBranding(w, r)
+	if !ok {
+		return
+	}
+	branding, err := cfg.db.GetBranding(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get branding", err)
+		return
+	}
+	oldKey, setBumper, ok := brandingBumper(w, r, branding)
+	if !ok {
+		return
+	}
+	if oldKey == nil {
+		respondWithError(w, http.StatusNotFound, "No "+r.PathValue("bumper")+" set", nil)
+		return
+	}
+
+	err = setBumper(cfg.db, userID, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update branding", err)
+		return
+	}
+	cfg.deleteReplacedBrandingFile(r.Context(), oldKey, "")
+	cfg.respondWithBranding(w, userID)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+type captionResponse struct {
+	database.Caption
+	URL string `json:"url"`
+}
+
+func (cfg *apiConfig) newCaptionResponse(caption database.Caption) captionResponse {
+	return captionResponse{
+		Caption: caption,
+		URL:     cfg.getObjectURL(caption.Key),
+	}
+}
+
+// handlerCaptionUpload adds or replaces a video's caption track for a
+// language. The form takes the track as "captions", in SRT or WebVTT, with
+// its "language" and an optional "label" for players to show.
+func (cfg *apiConfig) handlerCaptionUpload(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// Leave room for the rest of the form around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionSize+64<<10)
+	err = r.ParseMultipartForm(maxCaptionSize)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+		return
+	}
+
+	language, ok := normalizeCaptionLanguage(r.FormValue("language"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Language must be a BCP 47 tag such as en or pt-BR", nil)
+		return
+	}
+	label := strings.TrimSpace(r.FormValue("label"))
+	if label == "" {
+		label = language
+	}
+
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxCaptionSize+1))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error reading file", err)
+		return
+	}
+	if len(data) > maxCaptionSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Captions are too large", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	vtt, err := toWebVTT(data)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid captions: "+err.Error(), err)
+		return
+	}
+
+	key := getCaptionKey(videoID, language, vtt)
+	err = cfg.storage.Put(r.Context(), key, bytes.NewReader(vtt), storage.PutOptions{
+		ContentType: "text/vtt",
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+
+	previous, err := cfg.db.GetCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	caption, err := cfg.db.SetCaption(database.CreateCaptionParams{
+		VideoID:  videoID,
+		Language: language,
+		Label:    label,
+		Key:      key,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+	if previous.ID != uuid.Nil && previous.Key != key {
+		cfg.deleteCaptionFile(r.Context(), previous.Key)
+	}
+
+	err = cfg.updateHLSSubtitles(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't add captions to streaming playlists", err)
+		return
+	}
+
+	status := http.StatusCreated
+	if previous.ID != uuid.Nil {
+		status = http.StatusOK
+	}
+	respondWithJSON(w, status, cfg.newCaptionResponse(caption))
+}
+
+func (cfg *apiConfig) handlerCaptionsList(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	captions, err := cfg.db.GetCaptions(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+
+	response := make([]captionResponse, 0, len(captions))
+	for _, caption := range captions {
+		response = append(response, cfg.newCaptionResponse(caption))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) handlerCaptionDelete(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	language, ok := normalizeCaptionLanguage(r.PathValue("language"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid language", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	caption, err := cfg.db.GetCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	if caption.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Captions not found", nil)
+		return
+	}
+
+	err = cfg.db.DeleteCaption(videoID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete captions", err)
+		return
+	}
+
+	err = cfg.updateHLSSubtitles(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove captions from streaming playlists", err)
+		return
+	}
+	cfg.deleteCaptionFile(r.Context(), caption.Key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteCaptionFile removes a caption file nothing points at any more. The
+// deletion is retried in the background if it fails now.
+func (cfg *apiConfig) deleteCaptionFile(ctx context.Context, key string) {
+	err := cfg.deleteStoredObjects(ctx, []database.CreatePendingDeletionParams{
+		{Store: deletionStoreStorage, Key: key},
+	})
+	if err != nil {
+		log.Printf("Couldn't delete caption file %s: %v", key, err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type chapterParameters struct {
+	StartTime *float64 `json:"start_time"`
+	Title     string   `json:"title"`
+}
+
+// apply checks the parameters and copies them onto a chapter, keeping its
+// start time to the millisecond.
+func (params chapterParameters) apply(chapter *database.Chapter) error {
+	if params.StartTime == nil {
+		return errors.New("start_time is required")
+	}
+	title, err := normalizeChapterTitle(params.Title)
+	if err != nil {
+		return err
+	}
+	chapter.StartTime = math.Round(*params.StartTime*1000) / 1000
+	chapter.Title = title
+	return nil
+}
+
+func (cfg *apiConfig) handlerChaptersList(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	chapters, err := cfg.db.GetChapters(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chapters", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chapters)
+}
+
+func (cfg *apiConfig) handlerChapterCreate(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := chapterParameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	chapter := database.Chapter{CreateChapterParams: database.CreateChapterParams{VideoID: videoID}}
+	if !cfg.checkChapter(w, video, params, &chapter) {
+		return
+	}
+
+	chapter, err = cfg.db.CreateChapter(chapter.CreateChapterParams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chapter", err)
+		return
+	}
+
+	err = cfg.publishChapters(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't publish chapters", err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, chapter)
+}
+
+func (cfg *apiConfig) handlerChapterUpdate(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	chapterID, err := uuid.Parse(r.PathValue("chapterID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chapter ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := chapterParameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	chapter, err := cfg.db.GetChapter(chapterID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chapter", err)
+		return
+	}
+	if chapter.ID == uuid.Nil || chapter.VideoID != videoID {
+		respondWithError(w, http.StatusNotFound, "Chapter not found", nil)
+		return
+	}
+	if !cfg.checkChapter(w, video, params, &chapter) {
+		return
+	}
+
+	err = cfg.db.UpdateChapter(chapter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update chapter", err)
+		return
+	}
+	chapter, err = cfg.db.GetChapter(chapterID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chapter", err)
+		return
+	}
+
+	err = cfg.publishChapters(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't publish chapters", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chapter)
+}
+
+func (cfg *apiConfig) handlerChapterDelete(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	chapterID, err := uuid.Parse(r.PathValue("chapterID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chapter ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	chapter, err := cfg.db.GetChapter(chapterID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chapter", err)
+		return
+	}
+	if chapter.ID == uuid.Nil || chapter.VideoID != videoID {
+		respondWithError(w, http.StatusNotFound, "Chapter not found", nil)
+		return
+	}
+
+	err = cfg.db.DeleteChapter(chapterID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete chapter", err)
+		return
+	}
+
+	err = cfg.publishChapters(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't publish chapters", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkChapter applies params to a chapter and validates it against the
+// video's other chapters, responding with the problem if there is one.
+func (cfg *apiConfig) checkChapter(w http.ResponseWriter, video database.Video, params chapterParameters, chapter *database.Chapter) bool {
+	err := params.apply(chapter)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chapter: "+err.Error(), err)
+		return false
+	}
+
+	chapters, err := cfg.db.GetChapters(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chapters", err)
+		return false
+	}
+	duration, err := cfg.getContentDuration(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video duration", err)
+		return false
+	}
+	err = validateChapter(duration, chapters, *chapter)
+	if errors.Is(err, errChapterStartTaken) {
+		respondWithError(w, http.StatusConflict, "Invalid chapter: "+err.Error(), err)
+		return false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chapter: "+err.Error(), err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// clipAcceptedResponse is the new clip, which is processed in the background
+// like an upload.
+type clipAcceptedResponse struct {
+	database.Video
+	JobID uuid.UUID `json:"job_id"`
+}
+
+// handlerClipCreate cuts a new video out of a time range of one of the
+// caller's own videos.
+func (cfg *apiConfig) handlerClipCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		StartTime   float64 `json:"start_time"`
+		EndTime     float64 `json:"end_time"`
+		Title       string  `json:"title"`
+		Description string  `json:"description"`
+		// Orientation crops the clip to 16:9, 9:16 or 1:1
+		Orientation string `json:"orientation"`
+	}
+
+	sourceID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if _, ok := clipCropRatios[params.Orientation]; params.Orientation != "" && !ok {
+		respondWithError(w, http.StatusBadRequest, "Orientation must be landscape, portrait or square", nil)
+		return
+	}
+
+	source, err := cfg.db.GetVideo(sourceID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if source.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if source.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't clip this video", nil)
+		return
+	}
+	if source.VideoURL == nil || source.MediaInfo == nil {
+		respondWithError(w, http.StatusConflict, "Video hasn't been processed yet", nil)
+		return
+	}
+	sourceKey, ok := cfg.getObjectKey(*source.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video file isn't in storage", nil)
+		return
+	}
+
+	duration := source.MediaInfo.Duration
+	switch {
+	case params.StartTime < 0 || params.EndTime > duration:
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Clip must be within the video, which is %s long", formatVTTTimestamp(duration)), nil)
+		return
+	case params.EndTime-params.StartTime < minClipLength:
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Clip must be at least %g seconds long", minClipLength), nil)
+		return
+	}
+
+	title := strings.TrimSpace(params.Title)
+	if title == "" {
+		title = source.Title + " (clip)"
+	}
+	clip, err := cfg.db.CreateClip(database.CreateVideoParams{
+		Title:       title,
+		Description: params.Description,
+		UserID:      userID,
+	}, sourceID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create clip", err)
+		return
+	}
+
+	job, err := cfg.enqueueJob(clip.ID, jobKindCreateClip, createClipPayload{
+		SourceKey:   sourceKey,
+		StartTime:   params.StartTime,
+		EndTime:     params.EndTime,
+		Orientation: params.Orientation,
+		UploaderID:  userID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue clip", err)
+		return
+	}
+	err = cfg.setProcessingStatus(clip.ID, database.ProcessingStatusQueued, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	clip.ProcessingStatus = database.ProcessingStatusQueued
+
+	respondWithJSON(w, http.StatusAccepted, clipAcceptedResponse{Video: clip, JobID: job.ID})
+}
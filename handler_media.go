@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// publicMediaPrefixes are the parts of storage that published URLs point
+// into. Everything else, like staged uploads, isn't served.
+var publicMediaPrefixes = []string{
+	"landscape/",
+	"portrait/",
+	"square/",
+	"other/",
+	"thumbnails/",
+	"videos/",
+	"branding/",
+}
+
+func isPublicMediaKey(key string) bool {
+	for _, prefix := range publicMediaPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerMedia serves objects straight from storage for backends that have no
+// CDN in front of them (local and memory).
+func (cfg *apiConfig) handlerMedia(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !isPublicMediaKey(key) {
+		respondWithError(w, http.StatusNotFound, "Object not found", nil)
+		return
+	}
+
+	body, info, err := cfg.storage.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Object not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read object", err)
+		return
+	}
+	defer body.Close()
+
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+
+	// Seekable bodies get range request support so the video player can scrub
+	if rs, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), info.LastModified, rs)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	io.Copy(w, body)
+}
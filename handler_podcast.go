@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// podcastResponse is a user's podcast settings, with the URL of their feed.
+type podcastResponse struct {
+	database.Podcast
+	FeedURL string `json:"feed_url"`
+}
+
+// requestBaseURL is the scheme and host a request was made to, as the client
+// sees it.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func getPodcastFeedPath(userID uuid.UUID) string {
+	return fmt.Sprintf("/feeds/%s/podcast.xml", userID)
+}
+
+func (cfg *apiConfig) handlerPodcastGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	podcast, err := cfg.db.GetPodcast(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get podcast", err)
+		return
+	}
+	if podcast.UserID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Podcast not set up", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, podcastResponse{
+		Podcast: podcast,
+		FeedURL: requestBaseURL(r) + getPodcastFeedPath(userID),
+	})
+}
+
+// handlerPodcastUpdate sets up or changes the caller's podcast. Feeds are
+// only published for users who have set one up, so nobody's videos end up in
+// podcast directories without them asking.
+func (cfg *apiConfig) handlerPodcastUpdate(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := database.PodcastParams{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	params.Title = strings.Join(strings.Fields(params.Title), " ")
+	params.Author = strings.Join(strings.Fields(params.Author), " ")
+	params.Category = strings.TrimSpace(params.Category)
+	params.Description = strings.TrimSpace(params.Description)
+	switch {
+	case params.Title == "":
+		respondWithError(w, http.StatusBadRequest, "Title is required", nil)
+		return
+	case len([]rune(params.Title)) > maxPodcastTitleLength || len([]rune(params.Author)) > maxPodcastTitleLength || len([]rune(params.Category)) > maxPodcastTitleLength:
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Title, author and category can't be longer than %d characters", maxPodcastTitleLength), nil)
+		return
+	case len([]rune(params.Description)) > maxPodcastDescriptionLength:
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Description can't be longer than %d characters", maxPodcastDescriptionLength), nil)
+		return
+	}
+	if params.Language != "" {
+		language, ok := normalizeCaptionLanguage(params.Language)
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, "Language must be a BCP 47 tag such as en or pt-BR", nil)
+			return
+		}
+		params.Language = language
+	}
+
+	podcast, err := cfg.db.SetPodcast(userID, params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update podcast", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, podcastResponse{
+		Podcast: podcast,
+		FeedURL: requestBaseURL(r) + getPodcastFeedPath(userID),
+	})
+}
+
+// handlerPodcastDelete takes down the caller's feed. Their videos keep their
+// audio, so it can be put back up at any time.
+func (cfg *apiConfig) handlerPodcastDelete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	err = cfg.db.DeletePodcast(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete podcast", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPodcastFeed serves a user's podcast as RSS. Feeds are public, like
+// the videos in them.
+func (cfg *apiConfig) handlerPodcastFeed(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	podcast, err := cfg.db.GetPodcast(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get podcast", err)
+		return
+	}
+	if podcast.UserID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Podcast not found", nil)
+		return
+	}
+
+	videos, err := cfg.db.GetVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get videos", err)
+		return
+	}
+
+	feed, err := buildPodcastFeed(podcast, videos, requestBaseURL(r)+"/app/")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build feed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(feed)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerVideoPosterRegenerate replaces a video's thumbnail with the frame at
+// a chosen timestamp, in seconds, of its current file.
+func (cfg *apiConfig) handlerVideoPosterRegenerate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Timestamp *float64 `json:"timestamp"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Timestamp == nil || *params.Timestamp < 0 {
+		respondWithError(w, http.StatusBadRequest, "Timestamp must be a number of seconds from the start", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video hasn't been uploaded yet", nil)
+		return
+	}
+	if video.MediaInfo != nil && *params.Timestamp >= video.MediaInfo.Duration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Timestamp must be within the video, which is %s long", formatVTTTimestamp(video.MediaInfo.Duration)), nil)
+		return
+	}
+	sourceKey, ok := cfg.getObjectKey(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video file isn't in storage", nil)
+		return
+	}
+
+	job, err := cfg.enqueueJob(videoID, jobKindPoster, generatePosterPayload{
+		SourceKey: sourceKey,
+		Timestamp: params.Timestamp,
+		Replace:   true,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue poster", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, uploadAcceptedResponse{JobID: job.ID})
+}
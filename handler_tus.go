@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads speak tus 1.0 (https://tus.io/protocols/resumable-upload)
+// with the creation, expiration and termination extensions.
+const (
+	tusVersion       = "1.0.0"
+	tusExtensions    = "creation,expiration,termination"
+	tusUploadTTL     = 24 * time.Hour
+	tusSweepInterval = 10 * time.Minute
+)
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(maxVideoUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't upload to this video", nil)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Length", err)
+		return
+	}
+	if length > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	fields, err := parseTusMetadata(metadata)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err)
+		return
+	}
+	if filetype, ok := fields["filetype"]; ok && !cfg.uploadContentTypes.allows(filetype) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type, expected one of "+cfg.uploadContentTypes.String(), nil)
+		return
+	}
+
+	upload, err := cfg.db.CreateUpload(database.CreateUploadParams{
+		VideoID:   videoID,
+		UserID:    userID,
+		Length:    length,
+		Metadata:  metadata,
+		ExpiresAt: time.Now().UTC().Add(tusUploadTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+
+	f, err := os.Create(cfg.uploadDiskPath(upload.ID))
+	if err != nil {
+		cfg.db.DeleteUpload(upload.ID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Location", fmt.Sprintf("/api/tus/%s/%s", videoID, upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if !cfg.uploadLocks.tryLock(upload.ID) {
+		respondWithError(w, http.StatusLocked, "Upload is already being written to", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(upload.ID)
+
+	// Re-read now that we hold the lock in case a previous PATCH just finished
+	upload, err := cfg.db.GetUpload(upload.ID)
+	if err != nil || upload.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", err)
+		return
+	}
+	if offset != upload.Offset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return
+	}
+
+	f, err := os.OpenFile(cfg.uploadDiskPath(upload.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+		return
+	}
+	defer f.Close()
+
+	// Drop anything left over from a request that was cut off after the last
+	// recorded offset
+	err = f.Truncate(upload.Offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+		return
+	}
+	_, err = f.Seek(upload.Offset, io.SeekStart)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+		return
+	}
+
+	// Keep whatever made it to disk even if the client disconnects part way,
+	// that's the whole point of resuming
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-upload.Offset))
+	if err := f.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	upload.Offset += n
+	upload.ExpiresAt = time.Now().UTC().Add(tusUploadTTL)
+
+	err = cfg.db.UpdateUploadOffset(upload.ID, upload.Offset, upload.ExpiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+		return
+	}
+	if copyErr != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write chunk", copyErr)
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		job, err := cfg.finishTusUpload(r.Context(), upload)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+			return
+		}
+		// tus requires a 204 here, so the job comes back in a header instead
+		// of a body
+		w.Header().Set("Tubely-Job-ID", job.ID.String())
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	upload, ok := cfg.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if !cfg.uploadLocks.tryLock(upload.ID) {
+		respondWithError(w, http.StatusLocked, "Upload is already being written to", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(upload.ID)
+
+	err := cfg.removeTusUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload moves a fully assembled upload into staging and queues it
+// for the normal video pipeline.
+func (cfg *apiConfig) finishTusUpload(ctx context.Context, upload database.Upload) (database.Job, error) {
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		return database.Job{}, err
+	}
+	if video.ID == uuid.Nil {
+		return database.Job{}, errors.New("video no longer exists")
+	}
+
+	f, err := os.Open(cfg.uploadDiskPath(upload.ID))
+	if err != nil {
+		return database.Job{}, err
+	}
+	defer f.Close()
+
+	contentType := "video/mp4"
+	if fields, err := parseTusMetadata(upload.Metadata); err == nil && fields["filetype"] != "" {
+		contentType = fields["filetype"]
+	}
+
+	stagingKey, err := newStagingUploadKey(video.ID)
+	if err != nil {
+		return database.Job{}, err
+	}
+	err = cfg.storage.Put(ctx, stagingKey, f, storage.PutOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+
+	job, err := cfg.enqueueUpload(video.ID, processUploadPayload{
+		SourceKey:  stagingKey,
+		UploaderID: upload.UserID,
+	})
+	if err != nil {
+		cfg.storage.Delete(ctx, stagingKey)
+		return database.Job{}, err
+	}
+	// The job owns the bytes now, so a leftover upload is only untidy and will
+	// be expired later
+	if err := cfg.removeTusUpload(upload.ID); err != nil {
+		log.Printf("Couldn't remove finished upload %s: %v", upload.ID, err)
+	}
+	return job, nil
+}
+
+// getTusUpload loads the upload named in the path and makes sure it belongs to
+// the caller. It writes the error response itself and reports whether the
+// request can go on.
+func (cfg *apiConfig) getTusUpload(w http.ResponseWriter, r *http.Request) (database.Upload, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.Upload{}, false
+	}
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID", err)
+		return database.Upload{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Upload{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Upload{}, false
+	}
+
+	upload, err := cfg.db.GetUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.Upload{}, false
+	}
+	if upload.ID == uuid.Nil || upload.VideoID != videoID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.Upload{}, false
+	}
+	if upload.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't access this upload", nil)
+		return database.Upload{}, false
+	}
+	if time.Now().UTC().After(upload.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload has expired", nil)
+		return database.Upload{}, false
+	}
+
+	return upload, true
+}
+
+func (cfg *apiConfig) removeTusUpload(id uuid.UUID) error {
+	err := os.Remove(cfg.uploadDiskPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return cfg.db.DeleteUpload(id)
+}
+
+// expireTusUploads periodically drops uploads that haven't seen a chunk within
+// tusUploadTTL, until ctx is cancelled.
+func (cfg *apiConfig) expireTusUploads(ctx context.Context) {
+	ticker := time.NewTicker(tusSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		ids, err := cfg.db.GetExpiredUploads(time.Now().UTC())
+		if err != nil {
+			log.Printf("Couldn't list expired uploads: %v", err)
+		}
+		for _, id := range ids {
+			if !cfg.uploadLocks.tryLock(id) {
+				continue
+			}
+			err := cfg.removeTusUpload(id)
+			cfg.uploadLocks.unlock(id)
+			if err != nil {
+				log.Printf("Couldn't remove expired upload %s: %v", id, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) uploadDiskPath(id uuid.UUID) string {
+	return filepath.Join(cfg.uploadsRoot, id.String()+".bin")
+}
+
+// checkTusResumable sets the Tus-Resumable response header and rejects
+// clients that speak a different protocol version.
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, which is a comma
+// separated list of "key base64(value)" pairs.
+func parseTusMetadata(header string) (map[string]string, error) {
+	fields := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return fields, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			fields[parts[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %q: %w", parts[0], err)
+			}
+			fields[parts[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("invalid metadata pair %q", pair)
+		}
+	}
+	return fields, nil
+}
+
+// uploadLocker makes sure only one request writes to an upload at a time.
+type uploadLocker struct {
+	mu   sync.Mutex
+	held map[uuid.UUID]bool
+}
+
+func newUploadLocker() *uploadLocker {
+	return &uploadLocker{held: map[uuid.UUID]bool{}}
+}
+
+func (l *uploadLocker) tryLock(id uuid.UUID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[id] {
+		return false
+	}
+	l.held[id] = true
+	return true
+}
+
+func (l *uploadLocker) unlock(id uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.held, id)
+}
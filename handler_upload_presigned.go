@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	maxVideoUploadSize = 1 << 30
+	presignedUploadTTL = 15 * time.Minute
+)
+
+// handlerVideoUploadPresign hands the browser a presigned PUT URL so the video
+// bytes go straight to the bucket instead of through this server.
+func (cfg *apiConfig) handlerVideoUploadPresign(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+	}
+	type response struct {
+		UploadURL   string    `json:"upload_url"`
+		Key         string    `json:"key"`
+		ContentType string    `json:"content_type"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.uploadContentTypes.allows(params.ContentType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type, expected one of "+cfg.uploadContentTypes.String(), nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized", fmt.Errorf("unauthorized"))
+		return
+	}
+
+	presigner, ok := cfg.storage.(storage.Presigner)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage backend doesn't support direct uploads", nil)
+		return
+	}
+
+	key, err := newStagingUploadKey(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
+		return
+	}
+
+	uploadURL, err := presigner.PresignPut(r.Context(), key, params.ContentType, presignedUploadTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		UploadURL:   uploadURL,
+		Key:         key,
+		ContentType: params.ContentType,
+		ExpiresAt:   time.Now().UTC().Add(presignedUploadTTL),
+	})
+}
+
+// handlerVideoUploadComplete is called once the browser has finished its
+// direct upload. The staged object is queued to be processed and published.
+func (cfg *apiConfig) handlerVideoUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !strings.HasPrefix(params.Key, stagingUploadPrefix(videoID)) {
+		respondWithError(w, http.StatusBadRequest, "Key doesn't belong to this video", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized", fmt.Errorf("unauthorized"))
+		return
+	}
+
+	info, err := cfg.storage.Stat(r.Context(), params.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Upload not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check upload", err)
+		return
+	}
+	if info.Size > maxVideoUploadSize {
+		cfg.storage.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+
+	// The upload is already staged, so it only needs queueing for processing
+	job, err := cfg.enqueueUpload(videoID, processUploadPayload{
+		SourceKey:  params.Key,
+		UploaderID: userID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, uploadAcceptedResponse{JobID: job.ID})
+}
+
+// uploadAcceptedResponse is returned once an upload has been queued for
+// processing. Progress can be followed through GET /api/jobs/{jobID}.
+type uploadAcceptedResponse struct {
+	JobID uuid.UUID `json:"job_id"`
+}
+
+// stagingUploadPrefix is where raw uploads for a video wait before processing.
+func stagingUploadPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("uploads/%s/", videoID)
+}
+
+func newStagingUploadKey(videoID uuid.UUID) (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%x.mp4", stagingUploadPrefix(videoID), randomBytes), nil
+}
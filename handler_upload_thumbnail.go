@@ -1,13 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
-	"os"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 	"github.com/google/uuid"
 )
 
@@ -32,14 +33,14 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Implement the upload with 10 MB
-	const maxMemory = 10 << 20  
+	const maxMemory = 10 << 20
 	err = r.ParseMultipartForm(maxMemory)
 	if err != nil {
 		respondWithError(w, 500, "error passing max memory", err)
 		return
 	}
 
-	// use the image data from the form 
+	// use the image data from the form
 	file, header, err := r.FormFile("thumbnail")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
@@ -47,7 +48,7 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	}
 	defer file.Close()
 
-		// Read all the image data into a byte slice using io.ReadAll 
+	// Read all the image data into a byte slice using io.ReadAll
 	mediaType := header.Header.Get("Content-Type")
 	if mediaType == "" {
 		respondWithError(w, http.StatusBadRequest, "Unable to get mediaType", nil)
@@ -61,49 +62,46 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	}
 
 	if mediaContentType != "image/jpeg" && mediaContentType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Content is not an image", nil) 
+		respondWithError(w, http.StatusBadRequest, "Content is not an image", nil)
 		return
 	}
 
-	
-
-	assetPath := getAssetPath(mediaType)
-
-	assetDiskPath := cfg.getAssetDiskPath(assetPath)
-
-
-	destinationFile, err := os.Create(assetDiskPath)
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to create file on server", err)
+		respondWithError(w, http.StatusInternalServerError, "Unable to get video from db", err)
+		return
 	}
 
-	defer destinationFile.Close()
-
-	if _, err = io.Copy(destinationFile, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
+	// if the authenticated user is not the video owner return htttp.StatusUnauthorized response
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Unathorized", fmt.Errorf("unauthorized"))
+		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	data, err := io.ReadAll(file)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to get video from db", err)
+		respondWithError(w, http.StatusInternalServerError, "Error reading file", err)
 		return
 	}
 
-		// if the authenticated user is not the video owner return htttp.StatusUnauthorized response
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Unathorized", fmt.Errorf("unauthorized"))	
+	thumbnailKey := getThumbnailKey(videoID, data, mediaContentType)
+
+	err = cfg.storage.Put(r.Context(), thumbnailKey, bytes.NewReader(data), storage.PutOptions{
+		ContentType: mediaContentType,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
 		return
 	}
 
-	url := cfg.getAssetURL(assetPath)
-	fmt.Printf("Url: %s", url)
+	url := cfg.getObjectURL(thumbnailKey)
 	video.ThumbnailURL = &url
-	
-	err = cfg.db.UpdateVideo(video)
+
+	err = cfg.db.UpdateVideoThumbnailURL(video.ID, url)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Unable to update video", err)
 		return
-	} 
+	}
 
 	respondWithJSON(w, http.StatusOK, video)
 }
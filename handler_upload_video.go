@@ -1,21 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
-	"math"
 	"mime"
 	"net/http"
-	"os"
-	"os/exec"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/google/uuid"
 )
@@ -32,7 +27,7 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	}
 	fmt.Printf("Video ID: %v", videoID)
 
-		// 3 - AUthenticate user to get userID
+	// 3 - AUthenticate user to get userID
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT\n", err)
@@ -42,15 +37,15 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT\n", err)
-		return 
+		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<30)
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize)
 	const maxMemory = 32 << 20
 	err = r.ParseMultipartForm(maxMemory)
 	if err != nil {
 		respondWithError(w, 500, "error passing max memory\n", err)
-		return 
+		return
 	}
 
 	// Parse loaded vido from form data
@@ -61,8 +56,7 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	}
 	defer file.Close()
 
-
-	// validate the upladed file to ensure it's mp4 
+	// validate the upladed file is a video type we accept
 	mediaType := header.Header.Get("Content-Type")
 	if mediaType == "" {
 		respondWithError(w, http.StatusBadRequest, "Unable to get mediaType\n", nil)
@@ -75,12 +69,11 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if mediaContentType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Content is not an image\n", nil)
+	if !cfg.uploadContentTypes.allows(mediaContentType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type, expected one of "+cfg.uploadContentTypes.String(), nil)
 		return
 	}
 
- 
 	// Get video metadata from database
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
@@ -93,158 +86,53 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Save the uploaded file as a temporay file on disk
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file: %v\n", err)
-		return
-	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
-
-	_, err = io.Copy(tempFile, file)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save temp file: %v\n", err)
-		return
-	}
-
-	// Reset tempFiles file pointer to begenning
-	_, err = tempFile.Seek(0, io.SeekStart)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't reset the temp file: %v\n", err)
-		return
-	}
-	
-
-	// Process the video for faster starts
-	fileName, err := processVideoForFastStart(tempFile.Name())
+	stagingKey, err := newStagingUploadKey(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to process video mov atom: %v\n", err)
-	}
-
-	// Get the aspect ratio to store in the bucket 
-	aspectRatio, err := getVideoAspectRatio(fileName)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes: %v\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes", err)
 		return
 	}
-	orientation := "other"
-	if aspectRatio == "16:9" {
-		orientation = "landscape"
-	} else if aspectRatio == "9:16" {
-		orientation = "portrait"
-	}
 
-	// Open the file to get a pointer to store 
-	processedFile, err := os.Open(fileName)
+	// Stage the upload for the worker pool, hashing it on the way so
+	// duplicates can be spotted
+	hasher := sha256.New()
+	err = cfg.storage.Put(r.Context(), stagingKey, io.TeeReader(file, hasher), storage.PutOptions{
+		ContentType: mediaContentType,
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error opening processed file: %v\n", err)
-	}
-	defer processedFile.Close()
-	
-	// Put object into S3 using PutObject 
-	randomBytes := make([]byte, 16)
-	_, err = rand.Read(randomBytes)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes: %v\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't stage upload", err)
 		return
 	}
-	fileKey := fmt.Sprintf("%v/%x.mp4", orientation, randomBytes)
-	
-	putObject := &s3.PutObjectInput{
-		Bucket: &cfg.s3Bucket,
-		Key: &fileKey,
-		Body: processedFile,
-		ContentType: &mediaContentType,
-	}
 
-	_, err = cfg.s3Client.PutObject(context.Background(), putObject)
+	job, err := cfg.enqueueUpload(videoID, processUploadPayload{
+		SourceKey:  stagingKey,
+		SHA256:     hex.EncodeToString(hasher.Sum(nil)),
+		UploaderID: userID,
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldnt upload file to s3: %v\n", err)
+		cfg.storage.Delete(r.Context(), stagingKey)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
 		return
 	}
-	
-	// Update the VideoURL of video record in database with s3 bucket and key
-	// s3URL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.s3Bucket, cfg.s3Region, fileKey)
-	// s3URL := fmt.Sprintf("%s,%s", cfg.s3Bucket, fileKey)
-
-	cloudFrontUrl := cfg.s3CfDistribution
-	s3URL := fmt.Sprintf("%s/%s", cloudFrontUrl, fileKey) 
 
-	video.VideoURL = &s3URL
-
-	err = cfg.db.UpdateVideo(video) 
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video url: %v\n", err)
-		return
-	}
-
-	respondWithJSON(w, http.StatusOK, struct{}{})
+	respondWithJSON(w, http.StatusAccepted, uploadAcceptedResponse{JobID: job.ID})
 	// 11 - restart server and test handler by uploading boots-video-vertical.mp4
 	// ensure video is uploaded to s3 bucket with key and shows up in webUI
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	type streams struct {
-		Width int `json:"width"`
-		Height int `json:"height"`
-	}
-
-	type FFProbeOutput struct {
-		Streams []streams `json:"streams"`
-	}
-
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-
-	var buffer bytes.Buffer
-
-	cmd.Stdout = &buffer 
-
-	err := cmd.Run()
-	if err != nil {
-		log.Fatalf("Error running command!: %v\n", err)
-	}
-
-	var output FFProbeOutput 
-
-	err = json.Unmarshal(buffer.Bytes(), &output)
-	if err != nil {
-		log.Fatalf("Error unmarshalling json data: %v\n", err)
-	}
-
-	width := output.Streams[0].Width 
-	height := output.Streams[0].Height
-
-	aspectRatio := float64(width) / float64(height)
-	
-	heightByWidth := math.Abs(aspectRatio -(16.0 / 9.0))
-	if heightByWidth < 0.01 {
-		return "16:9", nil
-	}
-	widthByHeight := math.Abs(aspectRatio -(9.0 / 16.0))
-	if widthByHeight < 0.01 {
-		return "9:16", nil
-	}
-	return "other", nil
-}
-
-func processVideoForFastStart(filePath string) (string, error) {
-	// Create a new string for output path (append .process to input)
-		// this should be the path to the temp file on disk 
+// processVideoForFastStart remuxes a video with its index at the front, so
+// playback can start before the whole file has downloaded. Only the streams
+// listed are kept, since subtitle and data tracks often can't go into an MP4.
+// If chaptersPath is set, the chapters in it replace any the video had.
+func (cfg *apiConfig) processVideoForFastStart(ctx context.Context, filePath, chaptersPath string, streams []int) (string, error) {
 	outputPath := filePath + ".processing"
-		// Create a new exec.Cmd command 
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputPath)
-	fmt.Printf("Command: %v", cmd) 
-
-	// Run the command 
-	err := cmd.Run()
+	args := append([]string{"-y", "-i", filePath}, chapterMetadataArgs(chaptersPath, 1)...)
+	for _, stream := range streams {
+		args = append(args, "-map", fmt.Sprintf("0:%d", stream))
+	}
+	args = append(args, "-sn", "-dn", "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputPath)
+	err := cfg.runFFmpeg(ctx, args...)
 	if err != nil {
-		log.Fatalf("Error running command: %v\n", err)
 		return "", err
 	}
-	// return the output file path 
-	fmt.Printf("Output path being returned %v\n", outputPath)
 	return outputPath, nil
 }
-
-
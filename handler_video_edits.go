@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// editsResponse is the list of edits a video's current file was rendered
+// with, and the original version they were applied to.
+type editsResponse struct {
+	OriginalVersionID uuid.UUID       `json:"original_version_id"`
+	CurrentVersionID  uuid.UUID       `json:"current_version_id"`
+	Operations        []editOperation `json:"operations"`
+}
+
+func newEditsResponse(current, original database.VideoVersion) (editsResponse, error) {
+	response := editsResponse{
+		OriginalVersionID: original.ID,
+		CurrentVersionID:  current.ID,
+		Operations:        []editOperation{},
+	}
+	if len(current.Edits) > 0 {
+		if err := json.Unmarshal(current.Edits, &response.Operations); err != nil {
+			return editsResponse{}, err
+		}
+	}
+	return response, nil
+}
+
+func (cfg *apiConfig) handlerVideoEditsGet(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't view this video's edits", nil)
+		return
+	}
+
+	current, original, ok, err := cfg.getEditVersions(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video versions", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video has no file to edit", nil)
+		return
+	}
+
+	response, err := newEditsResponse(current, original)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read edits", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handlerVideoEditsUpdate replaces a video's list of edits. The original
+// version is rendered again with the new list in the background, and the
+// result becomes a new current version.
+func (cfg *apiConfig) handlerVideoEditsUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Operations []editOperation `json:"operations"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if len(params.Operations) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No edits given, delete the edits to go back to the original", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	_, original, ok, err := cfg.getEditVersions(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video versions", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video has no file to edit", nil)
+		return
+	}
+	var probe videoProbe
+	if len(original.Probe) > 0 {
+		if err := json.Unmarshal(original.Probe, &probe); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't read version probe", err)
+			return
+		}
+	}
+	if probe.MediaInfo == nil {
+		respondWithError(w, http.StatusConflict, "Video's original file hasn't been probed, reprocess it first", nil)
+		return
+	}
+
+	operations, err := normalizeEdits(params.Operations, *probe.MediaInfo)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid edits: "+err.Error(), err)
+		return
+	}
+
+	job, err := cfg.enqueueJob(videoID, jobKindRenderEdits, renderEditsPayload{
+		SourceVersionID: original.ID,
+		Operations:      operations,
+		UploaderID:      userID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue edits", err)
+		return
+	}
+	err = cfg.setProcessingStatus(videoID, database.ProcessingStatusQueued, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, uploadAcceptedResponse{JobID: job.ID})
+}
+
+// handlerVideoEditsDelete reverts a video to the original its current file
+// was edited from. The edited version is kept, so it can still be restored.
+func (cfg *apiConfig) handlerVideoEditsDelete(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	current, original, ok, err := cfg.getEditVersions(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video versions", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video has no file to edit", nil)
+		return
+	}
+
+	if current.ID != original.ID {
+		err = cfg.makeVersionCurrent(r.Context(), original)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+			return
+		}
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
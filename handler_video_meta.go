@@ -40,6 +40,16 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Chapters listed in the description are a starting point the owner can
+	// edit from
+	for _, chapter := range parseDescriptionChapters(video.ID, video.Description) {
+		_, err = cfg.db.CreateChapter(chapter)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create chapters", err)
+			return
+		}
+	}
+
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
@@ -72,7 +82,13 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	versions, err := cfg.db.GetVideoVersions(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video versions", err)
+		return
+	}
+
+	err = cfg.deleteVideo(r.Context(), video, versions)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Blob is a stored video file identified by the SHA-256 of the upload it was
+// made from. Videos with identical uploads share one blob.
+type Blob struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	RefCount  int       `json:"ref_count"`
+	CreateBlobParams
+}
+
+type CreateBlobParams struct {
+	SHA256 string `json:"sha256"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+}
+
+// AcquireBlob adds a reference to the blob with the given hash and returns it.
+// It reports false, without changing anything, if there is no such blob.
+func (c Client) AcquireBlob(sha256 string) (Blob, bool, error) {
+	query := `
+	UPDATE blobs
+	SET
+		ref_count = ref_count + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE sha256 = ?
+	`
+	res, err := c.db.Exec(query, sha256)
+	if err != nil {
+		return Blob{}, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Blob{}, false, err
+	}
+	if n == 0 {
+		return Blob{}, false, nil
+	}
+
+	blob, err := c.GetBlob(sha256)
+	if err != nil {
+		return Blob{}, false, err
+	}
+	return blob, true, nil
+}
+
+// CreateBlob records a newly stored blob with a single reference. If another
+// upload of the same content won the race, that blob gets the reference
+// instead and is returned, so the caller should use its key.
+func (c Client) CreateBlob(params CreateBlobParams) (Blob, error) {
+	query := `
+	INSERT INTO blobs (
+		sha256,
+		created_at,
+		updated_at,
+		object_key,
+		size,
+		ref_count
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, 1)
+	ON CONFLICT(sha256) DO UPDATE SET
+		ref_count = ref_count + 1,
+		updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.db.Exec(query, params.SHA256, params.Key, params.Size)
+	if err != nil {
+		return Blob{}, err
+	}
+
+	return c.GetBlob(params.SHA256)
+}
+
+func (c Client) GetBlob(sha256 string) (Blob, error) {
+	query := `
+	SELECT
+		sha256,
+		created_at,
+		updated_at,
+		object_key,
+		size,
+		ref_count
+	FROM blobs
+	WHERE sha256 = ?
+	`
+
+	var blob Blob
+	err := c.db.QueryRow(query, sha256).Scan(
+		&blob.SHA256,
+		&blob.CreatedAt,
+		&blob.UpdatedAt,
+		&blob.Key,
+		&blob.Size,
+		&blob.RefCount,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Blob{}, nil
+		}
+		return Blob{}, err
+	}
+
+	return blob, nil
+}
+
+func (c Client) GetBlobKeys() ([]string, error) {
+	rows, err := c.db.Query(`SELECT object_key FROM blobs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// ReleaseBlob drops a reference to the blob stored at key, removing the blob
+// record once nothing refers to it. It returns the references left and
+// whether the key belonged to a blob at all.
+func (c Client) ReleaseBlob(key string) (int, bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	refCount, tracked, err := releaseBlob(tx, key)
+	if err != nil || !tracked {
+		return 0, false, err
+	}
+	return refCount, true, tx.Commit()
+}
+
+func releaseBlob(tx *sql.Tx, key string) (int, bool, error) {
+	var refCount int
+	err := tx.QueryRow(`SELECT ref_count FROM blobs WHERE object_key = ?`, key).Scan(&refCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	refCount--
+	if refCount > 0 {
+		_, err = tx.Exec(`UPDATE blobs SET ref_count = ?, updated_at = CURRENT_TIMESTAMP WHERE object_key = ?`, refCount, key)
+	} else {
+		refCount = 0
+		_, err = tx.Exec(`DELETE FROM blobs WHERE object_key = ?`, key)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return refCount, true, nil
+}
+
+// RenameVideoObject repoints everything that refers to a stored video file at
+// a new key, after the file has been copied there.
+func (c Client) RenameVideoObject(oldKey, newKey, oldURL, newURL string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE blobs SET object_key = ?, updated_at = CURRENT_TIMESTAMP WHERE object_key = ?`, newKey, oldKey)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE video_versions SET object_key = ? WHERE object_key = ?`, newKey, oldKey)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE videos SET video_url = ?, updated_at = CURRENT_TIMESTAMP WHERE video_url = ?`, newURL, oldURL)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Branding is what a user's uploads are dressed in while they're processed:
+// a watermark over the video, and bumper videos played before and after it.
+type Branding struct {
+	UserID    uuid.UUID  `json:"user_id"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Watermark *Watermark `json:"watermark"`
+	IntroKey  *string    `json:"intro_key"`
+	OutroKey  *string    `json:"outro_key"`
+}
+
+type Watermark struct {
+	Key      string `json:"key"`
+	Position string `json:"position"`
+	// Opacity goes from 0, invisible, to 1
+	Opacity float64 `json:"opacity"`
+	// Scale is the watermark's width as a fraction of the video's
+	Scale float64 `json:"scale"`
+}
+
+// Empty reports whether there's nothing to brand uploads with.
+func (b Branding) Empty() bool {
+	return b.Watermark == nil && b.IntroKey == nil && b.OutroKey == nil
+}
+
+// GetBranding returns a user's branding, which is empty if they never set
+// any up.
+func (c Client) GetBranding(userID uuid.UUID) (Branding, error) {
+	query := `
+	SELECT
+		user_id,
+		updated_at,
+		watermark_key,
+		watermark_position,
+		watermark_opacity,
+		watermark_scale,
+		intro_key,
+		outro_key
+	FROM branding
+	WHERE user_id = ?
+	`
+
+	var branding Branding
+	var watermarkKey *string
+	var watermark Watermark
+	err := c.db.QueryRow(query, userID).Scan(
+		&branding.UserID,
+		&branding.UpdatedAt,
+		&watermarkKey,
+		&watermark.Position,
+		&watermark.Opacity,
+		&watermark.Scale,
+		&branding.IntroKey,
+		&branding.OutroKey,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Branding{UserID: userID}, nil
+	}
+	if err != nil {
+		return Branding{}, err
+	}
+	if watermarkKey != nil {
+		watermark.Key = *watermarkKey
+		branding.Watermark = &watermark
+	}
+	return branding, nil
+}
+
+// SetBrandingWatermark sets a user's watermark, or removes it if watermark is
+// nil.
+func (c Client) SetBrandingWatermark(userID uuid.UUID, watermark *Watermark) error {
+	var key *string
+	if watermark != nil {
+		key = &watermark.Key
+	} else {
+		watermark = &Watermark{}
+	}
+
+	query := `
+	INSERT INTO branding (
+		user_id,
+		created_at,
+		updated_at,
+		watermark_key,
+		watermark_position,
+		watermark_opacity,
+		watermark_scale
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		watermark_key = excluded.watermark_key,
+		watermark_position = excluded.watermark_position,
+		watermark_opacity = excluded.watermark_opacity,
+		watermark_scale = excluded.watermark_scale
+	`
+	_, err := c.db.Exec(query, userID, key, watermark.Position, watermark.Opacity, watermark.Scale)
+	return err
+}
+
+// SetBrandingIntro and SetBrandingOutro set the object key of a user's bumper
+// videos, or remove them if key is nil.
+func (c Client) SetBrandingIntro(userID uuid.UUID, key *string) error {
+	query := `
+	INSERT INTO branding (user_id, created_at, updated_at, intro_key)
+	VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		intro_key = excluded.intro_key
+	`
+	_, err := c.db.Exec(query, userID, key)
+	return err
+}
+
+func (c Client) SetBrandingOutro(userID uuid.UUID, key *string) error {
+	query := `
+	INSERT INTO branding (user_id, created_at, updated_at, outro_key)
+	VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		outro_key = excluded.outro_key
+	`
+	_, err := c.db.Exec(query, userID, key)
+	return err
+}
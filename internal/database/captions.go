@@ -0,0 +1,131 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Caption is a caption or subtitle track for a video in one language, stored
+// as WebVTT.
+type Caption struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	CreateCaptionParams
+}
+
+type CreateCaptionParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// Language is a BCP 47 tag such as "en" or "pt-BR"
+	Language string `json:"language"`
+	Label    string `json:"label"`
+	Key      string `json:"key"`
+}
+
+// SetCaption adds a video's track for a language, replacing any track it
+// already had.
+func (c Client) SetCaption(params CreateCaptionParams) (Caption, error) {
+	query := `
+	INSERT INTO captions (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		object_key
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	ON CONFLICT(video_id, language) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		label = excluded.label,
+		object_key = excluded.object_key
+	`
+	_, err := c.db.Exec(query, uuid.New(), params.VideoID, params.Language, params.Label, params.Key)
+	if err != nil {
+		return Caption{}, err
+	}
+
+	return c.GetCaption(params.VideoID, params.Language)
+}
+
+func (c Client) GetCaption(videoID uuid.UUID, language string) (Caption, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		object_key
+	FROM captions
+	WHERE video_id = ? AND language = ?
+	`
+
+	caption, err := scanCaption(c.db.QueryRow(query, videoID, language))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Caption{}, nil
+		}
+		return Caption{}, err
+	}
+	return caption, nil
+}
+
+func (c Client) GetCaptions(videoID uuid.UUID) ([]Caption, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		object_key
+	FROM captions
+	WHERE video_id = ?
+	ORDER BY language
+	`
+
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captions := []Caption{}
+	for rows.Next() {
+		caption, err := scanCaption(rows)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, caption)
+	}
+	return captions, rows.Err()
+}
+
+func (c Client) DeleteCaption(videoID uuid.UUID, language string) error {
+	query := `
+	DELETE FROM captions
+	WHERE video_id = ? AND language = ?
+	`
+	_, err := c.db.Exec(query, videoID, language)
+	return err
+}
+
+func scanCaption(row rowScanner) (Caption, error) {
+	var caption Caption
+	err := row.Scan(
+		&caption.ID,
+		&caption.CreatedAt,
+		&caption.UpdatedAt,
+		&caption.VideoID,
+		&caption.Language,
+		&caption.Label,
+		&caption.Key,
+	)
+	return caption, err
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Chapter marks where a named section of a video starts. It runs until the
+// next chapter starts, or the video ends.
+type Chapter struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	CreateChapterParams
+}
+
+type CreateChapterParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// StartTime is in seconds from the start of the video
+	StartTime float64 `json:"start_time"`
+	Title     string  `json:"title"`
+}
+
+func (c Client) CreateChapter(params CreateChapterParams) (Chapter, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO chapters (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		start_time,
+		title
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.StartTime, params.Title)
+	if err != nil {
+		return Chapter{}, err
+	}
+
+	return c.GetChapter(id)
+}
+
+func (c Client) GetChapter(id uuid.UUID) (Chapter, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		start_time,
+		title
+	FROM chapters
+	WHERE id = ?
+	`
+
+	chapter, err := scanChapter(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Chapter{}, nil
+		}
+		return Chapter{}, err
+	}
+	return chapter, nil
+}
+
+// GetChapters returns a video's chapters in the order they play.
+func (c Client) GetChapters(videoID uuid.UUID) ([]Chapter, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		start_time,
+		title
+	FROM chapters
+	WHERE video_id = ?
+	ORDER BY start_time
+	`
+
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chapters := []Chapter{}
+	for rows.Next() {
+		chapter, err := scanChapter(rows)
+		if err != nil {
+			return nil, err
+		}
+		chapters = append(chapters, chapter)
+	}
+	return chapters, rows.Err()
+}
+
+func (c Client) UpdateChapter(chapter Chapter) error {
+	query := `
+	UPDATE chapters
+	SET
+		start_time = ?,
+		title = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, chapter.StartTime, chapter.Title, chapter.ID)
+	return err
+}
+
+func (c Client) DeleteChapter(id uuid.UUID) error {
+	query := `
+	DELETE FROM chapters
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+func scanChapter(row rowScanner) (Chapter, error) {
+	var chapter Chapter
+	err := row.Scan(
+		&chapter.ID,
+		&chapter.CreatedAt,
+		&chapter.UpdatedAt,
+		&chapter.VideoID,
+		&chapter.StartTime,
+		&chapter.Title,
+	)
+	return chapter, err
+}
@@ -16,6 +16,9 @@ func NewClient(pathToDB string) (Client, error) {
 	if err != nil {
 		return Client{}, err
 	}
+	// SQLite only allows one writer at a time, and background workers write
+	// concurrently with requests, so funnel everything through one connection
+	db.SetMaxOpenConns(1)
 	c := Client{db}
 	err = c.autoMigrate()
 	if err != nil {
@@ -72,9 +75,300 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	uploadTable := `
+	CREATE TABLE IF NOT EXISTS uploads (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		upload_length INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		metadata TEXT NOT NULL DEFAULT '',
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(uploadTable)
+	if err != nil {
+		return err
+	}
+
+	pendingDeletionTable := `
+	CREATE TABLE IF NOT EXISTS pending_deletions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		store TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		is_prefix BOOLEAN NOT NULL DEFAULT FALSE,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(pendingDeletionTable)
+	if err != nil {
+		return err
+	}
+
+	blobTable := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		sha256 TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		object_key TEXT UNIQUE NOT NULL,
+		size INTEGER NOT NULL,
+		ref_count INTEGER NOT NULL DEFAULT 0
+	);
+	`
+	_, err = c.db.Exec(blobTable)
+	if err != nil {
+		return err
+	}
+
+	videoVersionTable := `
+	CREATE TABLE IF NOT EXISTS video_versions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL DEFAULT '',
+		probe TEXT NOT NULL DEFAULT '{}',
+		uploader_id TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(uploader_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(videoVersionTable)
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		state TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		payload TEXT NOT NULL DEFAULT '{}',
+		last_error TEXT NOT NULL DEFAULT '',
+		run_after TIMESTAMP NOT NULL,
+		lease_expires_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
+
+	captionTable := `
+	CREATE TABLE IF NOT EXISTS captions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		label TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		UNIQUE(video_id, language),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(captionTable)
+	if err != nil {
+		return err
+	}
+
+	chapterTable := `
+	CREATE TABLE IF NOT EXISTS chapters (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		start_time REAL NOT NULL,
+		title TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(chapterTable)
+	if err != nil {
+		return err
+	}
+
+	brandingTable := `
+	CREATE TABLE IF NOT EXISTS branding (
+		user_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		watermark_key TEXT,
+		watermark_position TEXT NOT NULL DEFAULT '',
+		watermark_opacity REAL NOT NULL DEFAULT 0,
+		watermark_scale REAL NOT NULL DEFAULT 0,
+		intro_key TEXT,
+		outro_key TEXT,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(brandingTable)
+	if err != nil {
+		return err
+	}
+
+	podcastsTable := `
+	CREATE TABLE IF NOT EXISTS podcasts (
+		user_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		author TEXT NOT NULL DEFAULT '',
+		language TEXT NOT NULL DEFAULT '',
+		category TEXT NOT NULL DEFAULT '',
+		explicit BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(podcastsTable)
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfMissing("videos", "processing_status", "TEXT NOT NULL DEFAULT 'none'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "hls_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_versions", "hls_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "dash_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_versions", "dash_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "storyboard_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_versions", "storyboard_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "chapters_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "parent_video_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_versions", "edited_from_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_versions", "edits", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "audio_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "audio_size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_versions", "audio_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_versions", "audio_size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("video_versions", "source_key", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	mediaInfoColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"probed_at", "TIMESTAMP"},
+		{"duration", "REAL NOT NULL DEFAULT 0"},
+		{"container", "TEXT NOT NULL DEFAULT ''"},
+		{"bit_rate", "INTEGER NOT NULL DEFAULT 0"},
+		{"video_codec", "TEXT NOT NULL DEFAULT ''"},
+		{"width", "INTEGER NOT NULL DEFAULT 0"},
+		{"height", "INTEGER NOT NULL DEFAULT 0"},
+		{"frame_rate", "REAL NOT NULL DEFAULT 0"},
+		{"rotation", "INTEGER NOT NULL DEFAULT 0"},
+		{"sample_aspect_ratio", "TEXT NOT NULL DEFAULT ''"},
+		{"aspect_ratio", "TEXT NOT NULL DEFAULT ''"},
+		{"orientation", "TEXT NOT NULL DEFAULT ''"},
+		{"audio_codec", "TEXT NOT NULL DEFAULT ''"},
+		{"audio_channels", "INTEGER NOT NULL DEFAULT 0"},
+		{"audio_channel_layout", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, column := range mediaInfoColumns {
+		err = c.addColumnIfMissing("videos", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// addColumnIfMissing adds a column to a table created by an older version of
+// autoMigrate, since CREATE TABLE IF NOT EXISTS won't touch existing tables.
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
@@ -82,8 +376,35 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM uploads"); err != nil {
+		return fmt.Errorf("failed to reset table uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM captions"); err != nil {
+		return fmt.Errorf("failed to reset table captions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM branding"); err != nil {
+		return fmt.Errorf("failed to reset table branding: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM podcasts"); err != nil {
+		return fmt.Errorf("failed to reset table podcasts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM chapters"); err != nil {
+		return fmt.Errorf("failed to reset table chapters: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_versions"); err != nil {
+		return fmt.Errorf("failed to reset table video_versions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM blobs"); err != nil {
+		return fmt.Errorf("failed to reset table blobs: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM pending_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table pending_deletions: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,137 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PendingDeletion is a stored object (or every object under a prefix) that
+// still has to be removed because the owning record is gone.
+type PendingDeletion struct {
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatePendingDeletionParams
+}
+
+type CreatePendingDeletionParams struct {
+	// Store names which store the key lives in, "storage" or "assets"
+	Store  string `json:"store"`
+	Key    string `json:"key"`
+	Prefix bool   `json:"prefix"`
+}
+
+func (c Client) CreatePendingDeletion(params CreatePendingDeletionParams) (PendingDeletion, error) {
+	return createPendingDeletion(c.db, params)
+}
+
+// execer runs statements on the database or inside a transaction.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func createPendingDeletion(db execer, params CreatePendingDeletionParams) (PendingDeletion, error) {
+	id := uuid.New()
+	now := time.Now().UTC()
+	query := `
+	INSERT INTO pending_deletions (
+		id,
+		created_at,
+		updated_at,
+		store,
+		object_key,
+		is_prefix,
+		attempts,
+		last_error,
+		next_attempt_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, '', ?)
+	`
+	_, err := db.Exec(query, id, params.Store, params.Key, params.Prefix, now)
+	if err != nil {
+		return PendingDeletion{}, err
+	}
+
+	return PendingDeletion{
+		ID:                          id,
+		CreatedAt:                   now,
+		UpdatedAt:                   now,
+		NextAttemptAt:               now,
+		CreatePendingDeletionParams: params,
+	}, nil
+}
+
+// GetDuePendingDeletions returns up to limit deletions whose next attempt is
+// at or before now, oldest first.
+func (c Client) GetDuePendingDeletions(now time.Time, limit int) ([]PendingDeletion, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		store,
+		object_key,
+		is_prefix,
+		attempts,
+		last_error,
+		next_attempt_at
+	FROM pending_deletions
+	WHERE next_attempt_at <= ?
+	ORDER BY next_attempt_at
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []PendingDeletion{}
+	for rows.Next() {
+		var d PendingDeletion
+		if err := rows.Scan(
+			&d.ID,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+			&d.Store,
+			&d.Key,
+			&d.Prefix,
+			&d.Attempts,
+			&d.LastError,
+			&d.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+
+	return deletions, rows.Err()
+}
+
+func (c Client) MarkPendingDeletionFailed(id uuid.UUID, lastError string, nextAttemptAt time.Time) error {
+	query := `
+	UPDATE pending_deletions
+	SET
+		attempts = attempts + 1,
+		last_error = ?,
+		next_attempt_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, lastError, nextAttemptAt.UTC(), id)
+	return err
+}
+
+func (c Client) DeletePendingDeletion(id uuid.UUID) error {
+	query := `
+	DELETE FROM pending_deletions
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
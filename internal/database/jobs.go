@@ -0,0 +1,267 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobState string
+
+const (
+	JobStateQueued    JobState = "queued"
+	JobStateRunning   JobState = "running"
+	JobStateSucceeded JobState = "succeeded"
+	JobStateFailed    JobState = "failed"
+)
+
+// Job is a unit of background work. Workers claim queued jobs by taking a
+// lease on them; a running job whose lease has run out is treated as
+// abandoned (its worker died) and can be claimed again.
+type Job struct {
+	ID             uuid.UUID  `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	State          JobState   `json:"state"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"last_error"`
+	RunAfter       time.Time  `json:"run_after"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	VideoID     uuid.UUID       `json:"video_id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	MaxAttempts int             `json:"max_attempts"`
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	now := time.Now().UTC()
+	payload := params.Payload
+	if len(payload) == 0 {
+		payload = json.RawMessage("{}")
+	}
+
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		kind,
+		state,
+		attempts,
+		max_attempts,
+		payload,
+		last_error,
+		run_after
+	) VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, '', ?)
+	`
+	_, err := c.db.Exec(query, id, now, now, params.VideoID, params.Kind, JobStateQueued, params.MaxAttempts, string(payload), now)
+	if err != nil {
+		return Job{}, err
+	}
+
+	return c.GetJob(id)
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		kind,
+		state,
+		attempts,
+		max_attempts,
+		payload,
+		last_error,
+		run_after,
+		lease_expires_at
+	FROM jobs
+	WHERE id = ?
+	`
+
+	job, err := scanJob(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// ClaimJob leases the oldest job that is ready to run, either because it's
+// queued and due or because its previous lease expired. It reports false if
+// there is nothing to do.
+func (c Client) ClaimJob(now time.Time, lease time.Duration) (Job, bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Job{}, false, err
+	}
+	defer tx.Rollback()
+
+	now = now.UTC()
+	var id uuid.UUID
+	err = tx.QueryRow(`
+	SELECT id
+	FROM jobs
+	WHERE (state = ? AND run_after <= ?)
+		OR (state = ? AND lease_expires_at < ?)
+	ORDER BY run_after
+	LIMIT 1
+	`, JobStateQueued, now, JobStateRunning, now).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	_, err = tx.Exec(`
+	UPDATE jobs
+	SET
+		state = ?,
+		attempts = attempts + 1,
+		lease_expires_at = ?,
+		updated_at = ?
+	WHERE id = ?
+	`, JobStateRunning, now.Add(lease), now, id)
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Job{}, false, err
+	}
+
+	job, err := c.GetJob(id)
+	if err != nil {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+// ExtendJobLease keeps a running job claimed while its worker is still busy.
+func (c Client) ExtendJobLease(id uuid.UUID, until time.Time) error {
+	query := `
+	UPDATE jobs
+	SET
+		lease_expires_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND state = ?
+	`
+	_, err := c.db.Exec(query, until.UTC(), id, JobStateRunning)
+	return err
+}
+
+// RequeueExpiredJobs puts running jobs whose lease has run out back in the
+// queue, returning how many there were. It's called on startup to recover
+// work from a process that crashed.
+func (c Client) RequeueExpiredJobs(now time.Time) (int64, error) {
+	query := `
+	UPDATE jobs
+	SET
+		state = ?,
+		lease_expires_at = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE state = ? AND lease_expires_at < ?
+	`
+	res, err := c.db.Exec(query, JobStateQueued, JobStateRunning, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (c Client) CompleteJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		state = ?,
+		lease_expires_at = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStateSucceeded, id)
+	return err
+}
+
+// HasJobSince reports whether a job of a kind has been queued for a video at
+// or after since.
+func (c Client) HasJobSince(videoID uuid.UUID, kind string, since time.Time) (bool, error) {
+	query := `
+	SELECT EXISTS (
+		SELECT 1
+		FROM jobs
+		WHERE video_id = ? AND kind = ? AND created_at >= ?
+	)
+	`
+	var exists bool
+	err := c.db.QueryRow(query, videoID, kind, since.UTC()).Scan(&exists)
+	return exists, err
+}
+
+// RetryJob records a failed attempt and queues the job to run again after
+// runAfter.
+func (c Client) RetryJob(id uuid.UUID, lastError string, runAfter time.Time) error {
+	query := `
+	UPDATE jobs
+	SET
+		state = ?,
+		last_error = ?,
+		run_after = ?,
+		lease_expires_at = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStateQueued, lastError, runAfter.UTC(), id)
+	return err
+}
+
+func (c Client) FailJob(id uuid.UUID, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET
+		state = ?,
+		last_error = ?,
+		lease_expires_at = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStateFailed, lastError, id)
+	return err
+}
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	var payload string
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.VideoID,
+		&job.Kind,
+		&job.State,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&payload,
+		&job.LastError,
+		&job.RunAfter,
+		&job.LeaseExpiresAt,
+	)
+	if err != nil {
+		return Job{}, err
+	}
+	job.Payload = json.RawMessage(payload)
+	return job, nil
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Podcast is how a user's videos are presented in their podcast feed. Users
+// without one don't have a feed.
+type Podcast struct {
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	PodcastParams
+}
+
+type PodcastParams struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	// Language is a BCP 47 tag such as en or pt-BR
+	Language string `json:"language"`
+	// Category is one of the categories Apple Podcasts lists shows under
+	Category string `json:"category"`
+	Explicit bool   `json:"explicit"`
+}
+
+// SetPodcast creates or replaces a user's podcast.
+func (c Client) SetPodcast(userID uuid.UUID, params PodcastParams) (Podcast, error) {
+	query := `
+	INSERT INTO podcasts (
+		user_id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		author,
+		language,
+		category,
+		explicit
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		title = excluded.title,
+		description = excluded.description,
+		author = excluded.author,
+		language = excluded.language,
+		category = excluded.category,
+		explicit = excluded.explicit
+	`
+	_, err := c.db.Exec(query, userID, params.Title, params.Description, params.Author, params.Language, params.Category, params.Explicit)
+	if err != nil {
+		return Podcast{}, err
+	}
+	return c.GetPodcast(userID)
+}
+
+// GetPodcast returns a user's podcast, or a zero Podcast if they don't have
+// one.
+func (c Client) GetPodcast(userID uuid.UUID) (Podcast, error) {
+	query := `
+	SELECT
+		user_id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		author,
+		language,
+		category,
+		explicit
+	FROM podcasts
+	WHERE user_id = ?
+	`
+
+	var podcast Podcast
+	err := c.db.QueryRow(query, userID).Scan(
+		&podcast.UserID,
+		&podcast.CreatedAt,
+		&podcast.UpdatedAt,
+		&podcast.Title,
+		&podcast.Description,
+		&podcast.Author,
+		&podcast.Language,
+		&podcast.Category,
+		&podcast.Explicit,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Podcast{}, nil
+	}
+	if err != nil {
+		return Podcast{}, err
+	}
+	return podcast, nil
+}
+
+func (c Client) DeletePodcast(userID uuid.UUID) error {
+	query := `
+	DELETE FROM podcasts
+	WHERE user_id = ?
+	`
+	_, err := c.db.Exec(query, userID)
+	return err
+}
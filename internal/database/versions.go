@@ -0,0 +1,329 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoVersion is one file that has been uploaded to a video. The video's
+// VideoURL points at whichever version is current.
+type VideoVersion struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// HLSKey and DASHKey are the version's streaming manifests, once it has
+	// been packaged
+	HLSKey  *string `json:"hls_key"`
+	DASHKey *string `json:"dash_key"`
+	// StoryboardKey is the WebVTT track of seek preview thumbnails
+	StoryboardKey *string `json:"storyboard_key"`
+	// AudioKey is the version's audio on its own, and AudioSize its size in
+	// bytes
+	AudioKey  *string `json:"audio_key"`
+	AudioSize int64   `json:"audio_size"`
+	CreateVideoVersionParams
+}
+
+type CreateVideoVersionParams struct {
+	VideoID    uuid.UUID       `json:"video_id"`
+	Key        string          `json:"key"`
+	Size       int64           `json:"size"`
+	SHA256     string          `json:"sha256"`
+	Probe      json.RawMessage `json:"probe"`
+	UploaderID uuid.UUID       `json:"uploader_id"`
+	// EditedFromID is the version this one was rendered from by applying
+	// Edits, or nil for an upload
+	EditedFromID *uuid.UUID      `json:"edited_from_id"`
+	Edits        json.RawMessage `json:"edits,omitempty"`
+	// SourceKey is the staged upload the version was published from, so a
+	// retried job can tell it already got that far
+	SourceKey *string `json:"-"`
+}
+
+func (c Client) CreateVideoVersion(params CreateVideoVersionParams) (VideoVersion, error) {
+	id := uuid.New()
+	createdAt := time.Now().UTC()
+	probe := params.Probe
+	if len(probe) == 0 {
+		probe = json.RawMessage("{}")
+	}
+
+	query := `
+	INSERT INTO video_versions (
+		id,
+		created_at,
+		video_id,
+		object_key,
+		size,
+		sha256,
+		probe,
+		uploader_id,
+		edited_from_id,
+		edits,
+		source_key
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	var edits *string
+	if len(params.Edits) > 0 {
+		s := string(params.Edits)
+		edits = &s
+	}
+	_, err := c.db.Exec(query, id, createdAt, params.VideoID, params.Key, params.Size, params.SHA256, string(probe), params.UploaderID, params.EditedFromID, edits, params.SourceKey)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+
+	return c.GetVideoVersion(id)
+}
+
+func (c Client) GetVideoVersion(id uuid.UUID) (VideoVersion, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		video_id,
+		object_key,
+		size,
+		sha256,
+		probe,
+		uploader_id,
+		hls_key,
+		dash_key,
+		storyboard_key,
+		audio_key,
+		audio_size,
+		edited_from_id,
+		edits,
+		source_key
+	FROM video_versions
+	WHERE id = ?
+	`
+
+	version, err := scanVideoVersion(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, nil
+		}
+		return VideoVersion{}, err
+	}
+	return version, nil
+}
+
+// GetVideoVersions returns every version of a video, newest first.
+func (c Client) GetVideoVersions(videoID uuid.UUID) ([]VideoVersion, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		video_id,
+		object_key,
+		size,
+		sha256,
+		probe,
+		uploader_id,
+		hls_key,
+		dash_key,
+		storyboard_key,
+		audio_key,
+		audio_size,
+		edited_from_id,
+		edits,
+		source_key
+	FROM video_versions
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	`
+
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []VideoVersion{}
+	for rows.Next() {
+		version, err := scanVideoVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// GetVideoVersionByKey returns the most recent version stored at key, from
+// any video. Deduplicated uploads use it to copy probe data.
+func (c Client) GetVideoVersionByKey(key string) (VideoVersion, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		video_id,
+		object_key,
+		size,
+		sha256,
+		probe,
+		uploader_id,
+		hls_key,
+		dash_key,
+		storyboard_key,
+		audio_key,
+		audio_size,
+		edited_from_id,
+		edits,
+		source_key
+	FROM video_versions
+	WHERE object_key = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+
+	version, err := scanVideoVersion(c.db.QueryRow(query, key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, nil
+		}
+		return VideoVersion{}, err
+	}
+	return version, nil
+}
+
+// GetVideoVersionBySource returns the version of a video published from a
+// staged upload, or a zero VideoVersion if there isn't one.
+func (c Client) GetVideoVersionBySource(videoID uuid.UUID, sourceKey string) (VideoVersion, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		video_id,
+		object_key,
+		size,
+		sha256,
+		probe,
+		uploader_id,
+		hls_key,
+		dash_key,
+		storyboard_key,
+		audio_key,
+		audio_size,
+		edited_from_id,
+		edits,
+		source_key
+	FROM video_versions
+	WHERE video_id = ? AND source_key = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+
+	version, err := scanVideoVersion(c.db.QueryRow(query, videoID, sourceKey))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, nil
+		}
+		return VideoVersion{}, err
+	}
+	return version, nil
+}
+
+func (c Client) GetVideoVersionKeys() ([]string, error) {
+	rows, err := c.db.Query(`SELECT DISTINCT object_key FROM video_versions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// UpdateVideoVersionProbes replaces the probe data of every version stored at
+// key.
+func (c Client) UpdateVideoVersionProbes(key string, probe json.RawMessage) error {
+	query := `
+	UPDATE video_versions
+	SET probe = ?
+	WHERE object_key = ?
+	`
+	_, err := c.db.Exec(query, string(probe), key)
+	return err
+}
+
+func (c Client) SetVideoVersionManifests(id uuid.UUID, hlsKey, dashKey *string) error {
+	query := `
+	UPDATE video_versions
+	SET
+		hls_key = ?,
+		dash_key = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, hlsKey, dashKey, id)
+	return err
+}
+
+func (c Client) SetVideoVersionStoryboardKey(id uuid.UUID, key string) error {
+	query := `
+	UPDATE video_versions
+	SET storyboard_key = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, key, id)
+	return err
+}
+
+func (c Client) SetVideoVersionAudio(id uuid.UUID, key string, size int64) error {
+	query := `
+	UPDATE video_versions
+	SET
+		audio_key = ?,
+		audio_size = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, key, size, id)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideoVersion(row rowScanner) (VideoVersion, error) {
+	var version VideoVersion
+	var probe string
+	var edits *string
+	err := row.Scan(
+		&version.ID,
+		&version.CreatedAt,
+		&version.VideoID,
+		&version.Key,
+		&version.Size,
+		&version.SHA256,
+		&probe,
+		&version.UploaderID,
+		&version.HLSKey,
+		&version.DASHKey,
+		&version.StoryboardKey,
+		&version.AudioKey,
+		&version.AudioSize,
+		&version.EditedFromID,
+		&edits,
+		&version.SourceKey,
+	)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+	version.Probe = json.RawMessage(probe)
+	if edits != nil {
+		version.Edits = json.RawMessage(*edits)
+	}
+	return version, nil
+}
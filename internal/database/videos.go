@@ -8,15 +8,68 @@ import (
 	"github.com/google/uuid"
 )
 
+type ProcessingStatus string
+
+const (
+	ProcessingStatusNone       ProcessingStatus = "none"
+	ProcessingStatusQueued     ProcessingStatus = "queued"
+	ProcessingStatusProcessing ProcessingStatus = "processing"
+	ProcessingStatusReady      ProcessingStatus = "ready"
+	ProcessingStatusFailed     ProcessingStatus = "failed"
+)
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID               uuid.UUID        `json:"id"`
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+	ThumbnailURL     *string          `json:"thumbnail_url"`
+	ChaptersURL      *string          `json:"chapters_url"`
+	ParentVideoID    *uuid.UUID       `json:"parent_video_id"`
+	ProcessingStatus ProcessingStatus `json:"processing_status"`
+	// MediaInfo describes the current file, and is nil until one has been
+	// probed
+	MediaInfo *MediaInfo `json:"media_info"`
+	VideoPlayback
 	CreateVideoParams
 }
 
+// MediaInfo is what ffprobe found out about a video file.
+type MediaInfo struct {
+	// Duration is in seconds
+	Duration  float64 `json:"duration"`
+	Container string  `json:"container"`
+	// BitRate is the overall bit rate in bits per second
+	BitRate    int64   `json:"bit_rate"`
+	VideoCodec string  `json:"video_codec"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	FrameRate  float64 `json:"frame_rate"`
+	// Rotation is the clockwise rotation in degrees players apply on display
+	Rotation          int    `json:"rotation"`
+	SampleAspectRatio string `json:"sample_aspect_ratio"`
+	// AspectRatio and Orientation describe the picture as displayed, after
+	// rotation and sample aspect ratio are applied
+	AspectRatio        string `json:"aspect_ratio"`
+	Orientation        string `json:"orientation"`
+	AudioCodec         string `json:"audio_codec"`
+	AudioChannels      int    `json:"audio_channels"`
+	AudioChannelLayout string `json:"audio_channel_layout"`
+}
+
+// VideoPlayback is where players can load the current version of a video
+// from. VideoURL is the faststart MP4, which every player can fall back to.
+type VideoPlayback struct {
+	VideoURL *string `json:"video_url"`
+	HLSURL   *string `json:"hls_url"`
+	DASHURL  *string `json:"dash_url"`
+	// StoryboardURL is a WebVTT track of thumbnails for seek previews
+	StoryboardURL *string `json:"storyboard_url"`
+	// AudioURL is the audio on its own, for listening and podcast feeds, and
+	// AudioSize its size in bytes
+	AudioURL  *string `json:"audio_url"`
+	AudioSize int64   `json:"audio_size"`
+}
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
@@ -33,6 +86,29 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
+		hls_url,
+		dash_url,
+		storyboard_url,
+		audio_url,
+		audio_size,
+		chapters_url,
+		parent_video_id,
+		processing_status,
+		probed_at,
+		duration,
+		container,
+		bit_rate,
+		video_codec,
+		width,
+		height,
+		frame_rate,
+		rotation,
+		sample_aspect_ratio,
+		aspect_ratio,
+		orientation,
+		audio_codec,
+		audio_channels,
+		audio_channel_layout,
 		user_id
 	FROM videos
 	WHERE user_id = ?
@@ -47,17 +123,66 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, nil
+}
+
+// GetAllVideos returns every video regardless of owner, for maintenance
+// commands that need to see the whole library.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		thumbnail_url,
+		video_url,
+		hls_url,
+		dash_url,
+		storyboard_url,
+		audio_url,
+		audio_size,
+		chapters_url,
+		parent_video_id,
+		processing_status,
+		probed_at,
+		duration,
+		container,
+		bit_rate,
+		video_codec,
+		width,
+		height,
+		frame_rate,
+		rotation,
+		sample_aspect_ratio,
+		aspect_ratio,
+		orientation,
+		audio_codec,
+		audio_channels,
+		audio_channel_layout,
+		user_id
+	FROM videos
+	ORDER BY created_at
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -67,6 +192,16 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+	return c.createVideo(params, nil)
+}
+
+// CreateClip creates a video cut from another one, linked back to it by
+// ParentVideoID.
+func (c Client) CreateClip(params CreateVideoParams, parentID uuid.UUID) (Video, error) {
+	return c.createVideo(params, &parentID)
+}
+
+func (c Client) createVideo(params CreateVideoParams, parentID *uuid.UUID) (Video, error) {
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,10 +210,11 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		parent_video_id
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID, parentID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -96,21 +232,35 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
+		hls_url,
+		dash_url,
+		storyboard_url,
+		audio_url,
+		audio_size,
+		chapters_url,
+		parent_video_id,
+		processing_status,
+		probed_at,
+		duration,
+		container,
+		bit_rate,
+		video_codec,
+		width,
+		height,
+		frame_rate,
+		rotation,
+		sample_aspect_ratio,
+		aspect_ratio,
+		orientation,
+		audio_codec,
+		audio_channels,
+		audio_channel_layout,
 		user_id
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -145,11 +295,248 @@ func (c Client) UpdateVideo(video Video) error {
 	return err
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+// UpdateVideoPlayback and UpdateVideoThumbnailURL only touch their own
+// columns, so background processing and requests can't clobber each other's
+// changes.
+func (c Client) UpdateVideoPlayback(id uuid.UUID, playback VideoPlayback) error {
 	query := `
-	DELETE FROM videos
+	UPDATE videos
+	SET
+		video_url = ?,
+		hls_url = ?,
+		dash_url = ?,
+		storyboard_url = ?,
+		audio_url = ?,
+		audio_size = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err := c.db.Exec(query, playback.VideoURL, playback.HLSURL, playback.DASHURL, playback.StoryboardURL, playback.AudioURL, playback.AudioSize, id)
 	return err
 }
+
+func (c Client) UpdateVideoThumbnailURL(id uuid.UUID, thumbnailURL string) error {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, thumbnailURL, id)
+	return err
+}
+
+// UpdateVideoChaptersURL points a video at the WebVTT track of its chapters,
+// or clears it when chaptersURL is nil.
+func (c Client) UpdateVideoChaptersURL(id uuid.UUID, chaptersURL *string) error {
+	query := `
+	UPDATE videos
+	SET
+		chapters_url = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, chaptersURL, id)
+	return err
+}
+
+// FillVideoThumbnailURL sets a thumbnail only if the video doesn't have one
+// yet, reporting whether it did.
+func (c Client) FillVideoThumbnailURL(id uuid.UUID, thumbnailURL string) (bool, error) {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND thumbnail_url IS NULL
+	`
+	res, err := c.db.Exec(query, thumbnailURL, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateVideoMediaInfo records the probe results for the video's current
+// file. A nil info clears them, for files that were never probed.
+func (c Client) UpdateVideoMediaInfo(id uuid.UUID, info *MediaInfo) error {
+	var probedAt *time.Time
+	if info != nil {
+		now := time.Now().UTC()
+		probedAt = &now
+	} else {
+		info = &MediaInfo{}
+	}
+
+	query := `
+	UPDATE videos
+	SET
+		probed_at = ?,
+		duration = ?,
+		container = ?,
+		bit_rate = ?,
+		video_codec = ?,
+		width = ?,
+		height = ?,
+		frame_rate = ?,
+		rotation = ?,
+		sample_aspect_ratio = ?,
+		aspect_ratio = ?,
+		orientation = ?,
+		audio_codec = ?,
+		audio_channels = ?,
+		audio_channel_layout = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query,
+		probedAt,
+		info.Duration,
+		info.Container,
+		info.BitRate,
+		info.VideoCodec,
+		info.Width,
+		info.Height,
+		info.FrameRate,
+		info.Rotation,
+		info.SampleAspectRatio,
+		info.AspectRatio,
+		info.Orientation,
+		info.AudioCodec,
+		info.AudioChannels,
+		info.AudioChannelLayout,
+		id,
+	)
+	return err
+}
+
+func (c Client) UpdateVideoProcessingStatus(id uuid.UUID, status ProcessingStatus) error {
+	query := `
+	UPDATE videos
+	SET
+		processing_status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
+	return err
+}
+
+// DeleteVideo deletes a video along with its versions, captions, chapters,
+// jobs and unfinished tus uploads, and unlinks any clips cut from it. In the
+// same transaction it records the deletion of the objects the video owns, so
+// none are left behind if the process stops before they're removed. Video
+// files are shared through blobs, so each of videoFiles is only deleted once
+// nothing else refers to it. It returns the deletions to attempt and the IDs
+// of the uploads it removed, whose data is kept outside the database.
+func (c Client) DeleteVideo(id uuid.UUID, objects, videoFiles []CreatePendingDeletionParams) ([]PendingDeletion, []uuid.UUID, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	for _, file := range videoFiles {
+		remaining, tracked, err := releaseBlob(tx, file.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !tracked || remaining == 0 {
+			objects = append(objects, file)
+		}
+	}
+
+	pending := []PendingDeletion{}
+	for _, object := range objects {
+		deletion, err := createPendingDeletion(tx, object)
+		if err != nil {
+			return nil, nil, err
+		}
+		pending = append(pending, deletion)
+	}
+
+	uploadIDs, err := getVideoUploadIDs(tx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	statements := []string{
+		`DELETE FROM jobs WHERE video_id = ?`,
+		`DELETE FROM uploads WHERE video_id = ?`,
+		`DELETE FROM captions WHERE video_id = ?`,
+		`DELETE FROM chapters WHERE video_id = ?`,
+		`DELETE FROM video_versions WHERE video_id = ?`,
+		`UPDATE videos SET parent_video_id = NULL WHERE parent_video_id = ?`,
+		`DELETE FROM videos WHERE id = ?`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return pending, uploadIDs, tx.Commit()
+}
+
+func getVideoUploadIDs(tx *sql.Tx, videoID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := tx.Query(`SELECT id FROM uploads WHERE video_id = ?`, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var info MediaInfo
+	var probedAt *time.Time
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.HLSURL,
+		&video.DASHURL,
+		&video.StoryboardURL,
+		&video.AudioURL,
+		&video.AudioSize,
+		&video.ChaptersURL,
+		&video.ParentVideoID,
+		&video.ProcessingStatus,
+		&probedAt,
+		&info.Duration,
+		&info.Container,
+		&info.BitRate,
+		&info.VideoCodec,
+		&info.Width,
+		&info.Height,
+		&info.FrameRate,
+		&info.Rotation,
+		&info.SampleAspectRatio,
+		&info.AspectRatio,
+		&info.Orientation,
+		&info.AudioCodec,
+		&info.AudioChannels,
+		&info.AudioChannelLayout,
+		&video.UserID,
+	)
+	if probedAt != nil {
+		video.MediaInfo = &info
+	}
+	return video, err
+}
@@ -0,0 +1,199 @@
+// Package ffmpeg runs the ffmpeg and ffprobe command line tools.
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// stderrTailBytes is how much of the end of a failed command's stderr is
+	// kept for its error
+	stderrTailBytes = 1024
+	// killWaitDelay is how long a cancelled command gets to close its output
+	// before Run gives up waiting on it
+	killWaitDelay = 5 * time.Second
+)
+
+// Command is a single run of ffmpeg or ffprobe.
+type Command struct {
+	// Program is the tool to run, "ffmpeg" or "ffprobe"
+	Program string
+	Args    []string
+	// Timeout overrides the runner's timeout when it's positive
+	Timeout time.Duration
+	// Stdout and Stderr, if set, receive the command's output as it's
+	// written
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Runner runs commands. Implementations return an *Error when a command
+// fails.
+type Runner interface {
+	Run(ctx context.Context, cmd Command) error
+}
+
+// RunnerFunc lets an ordinary function stand in for a Runner, e.g. a fake
+// that writes canned output.
+type RunnerFunc func(ctx context.Context, cmd Command) error
+
+func (f RunnerFunc) Run(ctx context.Context, cmd Command) error {
+	return f(ctx, cmd)
+}
+
+// ExecRunner runs commands as child processes. Each one gets its own process
+// group, which is killed as a whole if the context is cancelled or the
+// timeout passes.
+type ExecRunner struct {
+	// Timeout limits how long a command can run, zero means no limit
+	Timeout time.Duration
+}
+
+func (r ExecRunner) Run(ctx context.Context, c Command) error {
+	timeout := r.Timeout
+	if c.Timeout > 0 {
+		timeout = c.Timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stderr := &tailBuffer{limit: stderrTailBytes}
+	cmd := exec.CommandContext(ctx, c.Program, c.Args...)
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = stderr
+	if c.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(stderr, c.Stderr)
+	}
+	cmd.WaitDelay = killWaitDelay
+	setProcessGroup(cmd)
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	runErr := &Error{
+		Program:  c.Program,
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Err:      err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		runErr.ExitCode = exitErr.ExitCode()
+	}
+	// Being killed for running too long or being cancelled is more useful to
+	// callers than the signal that did it
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		runErr.Err = ctxErr
+	}
+	return runErr
+}
+
+// Error is returned when a command fails to start, exits unsuccessfully or is
+// killed. Err is context.DeadlineExceeded if it timed out and
+// context.Canceled if it was cancelled.
+type Error struct {
+	Program string
+	// ExitCode is -1 if the command didn't exit by itself
+	ExitCode int
+	// Stderr is the end of what the command wrote to stderr
+	Stderr string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	var reason string
+	switch {
+	case errors.Is(e.Err, context.DeadlineExceeded):
+		reason = "timed out"
+	case errors.Is(e.Err, context.Canceled):
+		reason = "cancelled"
+	default:
+		reason = e.Err.Error()
+	}
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s: %s", e.Program, reason)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Program, reason, e.Stderr)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.limit:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
+
+// ProgressWriter reads the key=value lines ffmpeg writes to it with
+// `-progress pipe:1`, and reports how far through Duration the output has
+// got as a fraction between 0 and 1.
+type ProgressWriter struct {
+	Duration   time.Duration
+	OnProgress func(fraction float64)
+	partial    []byte
+}
+
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+		w.handleLine(line)
+	}
+	return len(p), nil
+}
+
+func (w *ProgressWriter) handleLine(line string) {
+	key, value, _ := strings.Cut(line, "=")
+	var fraction float64
+	switch key {
+	case "out_time_us":
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || w.Duration <= 0 {
+			// ffmpeg writes N/A until it has output a frame
+			return
+		}
+		fraction = float64(us) / float64(w.Duration.Microseconds())
+	case "progress":
+		if value != "end" {
+			return
+		}
+		fraction = 1
+	default:
+		return
+	}
+	if w.OnProgress != nil {
+		w.OnProgress(min(max(fraction, 0), 1))
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package ffmpeg
+
+import "os/exec"
+
+// setProcessGroup does nothing where process groups aren't available, and
+// cancellation only kills the command itself.
+func setProcessGroup(cmd *exec.Cmd) {}
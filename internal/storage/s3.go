@@ -0,0 +1,389 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Store keeps objects in a single S3 bucket.
+type S3Store struct {
+	client *s3.Client
+	bucket string
+	opts   S3Options
+}
+
+// S3Options controls how large objects are split into a multipart upload.
+// Bodies smaller than PartSize are sent with a single PutObject. A PartSize
+// below the 5 MiB S3 allows is raised to it.
+type S3Options struct {
+	PartSize    int64
+	Concurrency int
+	PartRetries int
+}
+
+const (
+	// S3 rejects multipart uploads with parts smaller than 5 MiB
+	minPartSize = 5 << 20
+	// S3 allows at most 10,000 parts in a multipart upload
+	maxParts           = 10000
+	defaultPartSize    = 8 << 20
+	defaultConcurrency = 4
+)
+
+func NewS3Store(client *s3.Client, bucket string, opts S3Options) *S3Store {
+	switch {
+	case opts.PartSize <= 0:
+		opts.PartSize = defaultPartSize
+	case opts.PartSize < minPartSize:
+		opts.PartSize = minPartSize
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = defaultConcurrency
+	}
+	if opts.PartRetries < 0 {
+		opts.PartRetries = 0
+	}
+	return &S3Store{
+		client: client,
+		bucket: bucket,
+		opts:   opts,
+	}
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	partSize := s.opts.PartSize
+	if size, ok := remainingLength(body); ok && size > partSize*maxParts {
+		// Bigger parts keep the upload within S3's part limit
+		partSize = (size + maxParts - 1) / maxParts
+	}
+
+	first := make([]byte, partSize)
+	n, err := io.ReadFull(body, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putSingle(ctx, key, first[:n], opts)
+	}
+	if err != nil {
+		return err
+	}
+	return s.putMultipart(ctx, key, first, body, opts)
+}
+
+// remainingLength reports how much is left to read from body, if it can tell
+// without reading it. Files and in-memory readers are seekable, so it can.
+func remainingLength(body io.Reader) (int64, bool) {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := seeker.Seek(current, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return end - current, true
+}
+
+func (s *S3Store) putSingle(ctx context.Context, key string, data []byte, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	_, err := s.client.PutObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	opts.reportProgress(int64(len(data)))
+	return nil
+}
+
+// putMultipart streams body to S3 in chunks the size of first, uploading up
+// to Concurrency parts at once. Any part that still fails after its retries
+// aborts the whole upload so no orphaned parts are left in the bucket, as
+// does a body of unknown length that needs more parts than S3 allows.
+func (s *S3Store) putMultipart(ctx context.Context, key string, first []byte, body io.Reader, opts PutOptions) error {
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+	}
+	if opts.ContentType != "" {
+		createInput.ContentType = aws.String(opts.ContentType)
+	}
+	created, err := s.client.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		return err
+	}
+	uploadID := created.UploadId
+
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		number int32
+		data   []byte
+	}
+	parts := make(chan part)
+
+	var (
+		mu          sync.Mutex
+		completed   []types.CompletedPart
+		transferred int64
+		partErr     error
+		wg          sync.WaitGroup
+	)
+	for range s.opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				done, err := s.uploadPart(partCtx, key, uploadID, p.number, p.data)
+
+				mu.Lock()
+				if err != nil {
+					if partErr == nil {
+						partErr = err
+						cancel()
+					}
+				} else {
+					completed = append(completed, done)
+					transferred += int64(len(p.data))
+					opts.reportProgress(transferred)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var readErr error
+	next := part{number: 1, data: first}
+	for {
+		select {
+		case parts <- next:
+		case <-partCtx.Done():
+		}
+		if partCtx.Err() != nil || len(next.data) < len(first) {
+			break
+		}
+
+		buf := make([]byte, len(first))
+		n, err := io.ReadFull(body, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			readErr = err
+			break
+		}
+		if next.number == maxParts {
+			readErr = fmt.Errorf("storage: object is larger than %d parts of %d bytes", maxParts, len(first))
+			break
+		}
+		next = part{number: next.number + 1, data: buf[:n]}
+	}
+	close(parts)
+	wg.Wait()
+
+	if readErr == nil {
+		readErr = partErr
+	}
+	if readErr == nil {
+		readErr = ctx.Err()
+	}
+	if readErr != nil {
+		s.abortMultipart(key, uploadID)
+		return readErr
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return aws.ToInt32(completed[i].PartNumber) < aws.ToInt32(completed[j].PartNumber)
+	})
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: completed,
+		},
+	})
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (s *S3Store) uploadPart(ctx context.Context, key string, uploadID *string, number int32, data []byte) (types.CompletedPart, error) {
+	for attempt := 0; ; attempt++ {
+		out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			UploadId:          uploadID,
+			PartNumber:        aws.Int32(number),
+			Body:              bytes.NewReader(data),
+			ContentLength:     aws.Int64(int64(len(data))),
+			ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+		})
+		if err == nil {
+			return types.CompletedPart{
+				ETag:          out.ETag,
+				ChecksumCRC32: out.ChecksumCRC32,
+				PartNumber:    aws.Int32(number),
+			}, nil
+		}
+		if attempt >= s.opts.PartRetries || ctx.Err() != nil {
+			return types.CompletedPart{}, fmt.Errorf("upload part %d: %w", number, err)
+		}
+
+		backoff := time.Duration(1<<attempt) * 250 * time.Millisecond
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return types.CompletedPart{}, ctx.Err()
+		}
+	}
+}
+
+// abortMultipart discards uploaded parts. It deliberately ignores the caller's
+// context, which has usually been cancelled by the time we get here.
+func (s *S3Store) abortMultipart(key string, uploadID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Couldn't abort multipart upload of %s: %v", key, err)
+	}
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, mapS3Error(err)
+	}
+	return out.Body, ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, mapS3Error(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return mapS3Error(err)
+}
+
+func (s *S3Store) PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	presignClient := s3.NewPresignClient(s.client)
+	req, err := presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	objects := []ObjectInfo{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func mapS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return ErrNotFound
+	}
+	return err
+}
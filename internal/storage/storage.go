@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist in the store.
+var ErrNotFound = errors.New("storage: object not found")
+
+// Store is an object store that Tubely writes media to and reads it back from.
+// Keys are slash separated paths such as "landscape/abc123.mp4".
+type Store interface {
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Presigner is implemented by stores that can hand out a short lived URL for
+// clients to upload an object directly, without going through the API server.
+type Presigner interface {
+	PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error)
+}
+
+type PutOptions struct {
+	ContentType string
+	// Progress, if set, is called with the total number of bytes stored so far.
+	Progress func(transferred int64)
+}
+
+func (o PutOptions) reportProgress(transferred int64) {
+	if o.Progress != nil {
+		o.Progress(transferred)
+	}
+}
+
+// progressReader reports how much of a body has been read as it streams.
+type progressReader struct {
+	r    io.Reader
+	n    int64
+	opts PutOptions
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.n += int64(n)
+		p.opts.reportProgress(p.n)
+	}
+	return n, err
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+func cleanKey(key string) (string, error) {
+	if key == "" {
+		return "", errors.New("storage: empty key")
+	}
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return cleaned, nil
+}
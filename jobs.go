@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	jobKindProcessUpload = "process_upload"
+	jobKindPackageVideo  = "package_video"
+	jobKindPoster        = "generate_poster"
+	jobKindStoryboard    = "generate_storyboard"
+	jobKindCreateClip    = "create_clip"
+	jobKindRenderEdits   = "render_edits"
+	jobKindAudio         = "extract_audio"
+
+	jobMaxAttempts   = 3
+	jobLease         = time.Minute
+	jobHeartbeat     = 20 * time.Second
+	jobPollInterval  = 5 * time.Second
+	jobRetryBackoff  = 30 * time.Second
+	jobMaxErrorBytes = 1024
+)
+
+// processUploadPayload points a process_upload job at a raw upload waiting in
+// the staging area.
+type processUploadPayload struct {
+	SourceKey string `json:"source_key"`
+	// SHA256 is the hex digest of the upload, if the handler already knows it
+	SHA256     string    `json:"sha256,omitempty"`
+	UploaderID uuid.UUID `json:"uploader_id"`
+	// EditedFromID and Edits are set when the upload is a version rendered
+	// with edits (see renderEdits)
+	EditedFromID *uuid.UUID      `json:"edited_from_id,omitempty"`
+	Edits        json.RawMessage `json:"edits,omitempty"`
+	// Derived is set when the upload was rendered from a video that was
+	// already processed, like a clip, so it isn't branded a second time
+	Derived bool `json:"derived,omitempty"`
+	// ChapterOffset is where the video's own content starts in the upload,
+	// if it was rendered from a version with an intro
+	ChapterOffset float64 `json:"chapter_offset,omitempty"`
+	// OutroLength is how long the outro at the end of the upload is, likewise
+	OutroLength float64 `json:"outro_length,omitempty"`
+}
+
+// enqueueJob records a job and wakes an idle worker to pick it up.
+func (cfg *apiConfig) enqueueJob(videoID uuid.UUID, kind string, payload any) (database.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	job, err := cfg.db.CreateJob(database.CreateJobParams{
+		VideoID:     videoID,
+		Kind:        kind,
+		Payload:     data,
+		MaxAttempts: jobMaxAttempts,
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+
+	select {
+	case cfg.jobsReady <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// enqueueUpload queues a staged upload for processing and marks the video as
+// waiting on it.
+func (cfg *apiConfig) enqueueUpload(videoID uuid.UUID, payload processUploadPayload) (database.Job, error) {
+	job, err := cfg.enqueueJob(videoID, jobKindProcessUpload, payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	err = cfg.setProcessingStatus(videoID, database.ProcessingStatusQueued, "")
+	if err != nil {
+		return database.Job{}, err
+	}
+	return job, nil
+}
+
+// startJobWorkers requeues jobs abandoned by a previous process and starts
+// the worker pool.
+func (cfg *apiConfig) startJobWorkers(ctx context.Context, count int) error {
+	requeued, err := cfg.db.RequeueExpiredJobs(time.Now())
+	if err != nil {
+		return err
+	}
+	if requeued > 0 {
+		log.Printf("Requeued %d interrupted jobs", requeued)
+	}
+
+	for i := 0; i < count; i++ {
+		go cfg.jobWorker(ctx)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) jobWorker(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for cfg.runNextJob(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cfg.jobsReady:
+		}
+	}
+}
+
+// runNextJob claims and runs a single job, reporting whether there was one.
+func (cfg *apiConfig) runNextJob(ctx context.Context) bool {
+	job, ok, err := cfg.db.ClaimJob(time.Now(), jobLease)
+	if err != nil {
+		log.Printf("Couldn't claim job: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go cfg.heartbeatJob(jobCtx, job.ID, done)
+
+	err = cfg.runJob(jobCtx, job)
+	close(done)
+	cancel()
+
+	switch {
+	case err == nil:
+		err = cfg.db.CompleteJob(job.ID)
+	case job.Attempts >= job.MaxAttempts:
+		log.Printf("Job %s (%s) failed for good after %d attempts: %v", job.ID, job.Kind, job.Attempts, err)
+		cfg.abandonJob(ctx, job, err)
+		err = cfg.db.FailJob(job.ID, truncateJobError(err))
+	default:
+		log.Printf("Job %s (%s) failed, will retry: %v", job.ID, job.Kind, err)
+		if producesVideoFile(job.Kind) {
+			statusErr := cfg.setProcessingStatus(job.VideoID, database.ProcessingStatusQueued, truncateJobError(err))
+			if statusErr != nil {
+				log.Printf("Couldn't mark video %s as queued for retry: %v", job.VideoID, statusErr)
+			}
+		}
+		backoff := jobRetryBackoff << (job.Attempts - 1)
+		err = cfg.db.RetryJob(job.ID, truncateJobError(err), time.Now().Add(backoff))
+	}
+	if err != nil {
+		log.Printf("Couldn't record result of job %s: %v", job.ID, err)
+	}
+	return true
+}
+
+// heartbeatJob keeps extending a job's lease until done is closed, so other
+// workers don't mistake a long job for an abandoned one.
+func (cfg *apiConfig) heartbeatJob(ctx context.Context, jobID uuid.UUID, done <-chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := cfg.db.ExtendJobLease(jobID, time.Now().Add(jobLease))
+			if err != nil {
+				log.Printf("Couldn't extend lease on job %s: %v", jobID, err)
+			}
+		}
+	}
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, job database.Job) error {
+	switch job.Kind {
+	case jobKindProcessUpload:
+		var payload processUploadPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return err
+		}
+		return cfg.processUpload(ctx, job.VideoID, payload)
+	case jobKindPackageVideo:
+		var payload packageVideoPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return err
+		}
+		return cfg.packageVideo(ctx, payload)
+	case jobKindPoster:
+		var payload generatePosterPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return err
+		}
+		return cfg.generatePoster(ctx, job.VideoID, payload)
+	case jobKindStoryboard:
+		var payload generateStoryboardPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return err
+		}
+		return cfg.generateStoryboard(ctx, payload)
+	case jobKindCreateClip:
+		var payload createClipPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return err
+		}
+		return cfg.createClip(ctx, job.VideoID, payload)
+	case jobKindRenderEdits:
+		var payload renderEditsPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return err
+		}
+		return cfg.renderEdits(ctx, job.VideoID, payload)
+	case jobKindAudio:
+		var payload extractAudioPayload
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return err
+		}
+		return cfg.extractAudio(ctx, payload)
+	default:
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+}
+
+// producesVideoFile reports whether a kind of job makes a new file for a
+// video, so its processing status follows the job.
+func producesVideoFile(kind string) bool {
+	switch kind {
+	case jobKindProcessUpload, jobKindCreateClip, jobKindRenderEdits:
+		return true
+	default:
+		return false
+	}
+}
+
+// abandonJob cleans up after a job that won't be retried again.
+func (cfg *apiConfig) abandonJob(ctx context.Context, job database.Job, jobErr error) {
+	if job.Kind == jobKindProcessUpload {
+		var payload processUploadPayload
+		if err := json.Unmarshal(job.Payload, &payload); err == nil && payload.SourceKey != "" {
+			if err := cfg.storage.Delete(ctx, payload.SourceKey); err != nil {
+				log.Printf("Couldn't delete staged upload %s: %v", payload.SourceKey, err)
+			}
+		}
+	}
+	if producesVideoFile(job.Kind) {
+		err := cfg.setProcessingStatus(job.VideoID, database.ProcessingStatusFailed, truncateJobError(jobErr))
+		if err != nil {
+			log.Printf("Couldn't mark video %s as failed: %v", job.VideoID, err)
+		}
+	}
+}
+
+// processUpload publishes a staged upload, removes it from staging and queues
+// the follow up work for the new version.
+func (cfg *apiConfig) processUpload(ctx context.Context, videoID uuid.UUID, payload processUploadPayload) error {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		// The video was deleted while the job waited, along with its staged
+		// uploads, so there's nothing left to do
+		return nil
+	}
+
+	published, err := cfg.db.GetVideoVersionBySource(videoID, payload.SourceKey)
+	if err != nil {
+		return err
+	}
+	if published.ID != uuid.Nil {
+		// An earlier attempt published the upload before it was interrupted,
+		// possibly before it became the current version
+		err = cfg.resumePublishedUpload(ctx, video, published)
+		if err != nil {
+			return err
+		}
+		return cfg.finishUpload(ctx, video, published, payload)
+	}
+
+	body, bodyInfo, err := cfg.storage.Get(ctx, payload.SourceKey)
+	if errors.Is(err, storage.ErrNotFound) && video.ProcessingStatus == database.ProcessingStatusReady {
+		// An earlier attempt got as far as publishing before it was interrupted
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read staged upload: %w", err)
+	}
+	defer body.Close()
+
+	err = cfg.setProcessingStatus(videoID, database.ProcessingStatusProcessing, "")
+	if err != nil {
+		return err
+	}
+	progress := cfg.newVideoProgress(videoID)
+
+	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	progress.startStage(progressStageDownloading)
+	_, err = io.Copy(tempFile, &progressReader{r: body, onRead: progress.byteProgress(bodyInfo.Size)})
+	if err != nil {
+		return fmt.Errorf("couldn't download staged upload: %w", err)
+	}
+
+	chapters, err := cfg.db.GetChapters(videoID)
+	if err != nil {
+		return fmt.Errorf("couldn't get chapters: %w", err)
+	}
+	var branding *database.Branding
+	if !payload.Derived {
+		branding, err = cfg.getUploadBranding(video)
+		if err != nil {
+			return fmt.Errorf("couldn't get branding: %w", err)
+		}
+	}
+
+	version, err := cfg.publishVideo(ctx, video, rawUpload{
+		path:          tempFile.Name(),
+		sha256:        payload.SHA256,
+		uploaderID:    payload.UploaderID,
+		progress:      progress,
+		chapters:      chapters,
+		editedFromID:  payload.EditedFromID,
+		edits:         payload.Edits,
+		branding:      branding,
+		chapterOffset: payload.ChapterOffset,
+		outroLength:   payload.OutroLength,
+		sourceKey:     payload.SourceKey,
+	})
+	if err != nil {
+		return err
+	}
+	return cfg.finishUpload(ctx, video, version, payload)
+}
+
+// resumePublishedUpload makes an upload's version current if an interrupted
+// attempt didn't get to it, unless a newer version has been published since.
+func (cfg *apiConfig) resumePublishedUpload(ctx context.Context, video database.Video, version database.VideoVersion) error {
+	if video.VideoURL != nil {
+		if key, ok := cfg.getObjectKey(*video.VideoURL); ok && key == version.Key {
+			return nil
+		}
+	}
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 && versions[0].ID != version.ID {
+		return nil
+	}
+	return cfg.makeVersionCurrent(ctx, version)
+}
+
+// followUpJob is work queued for a version once it's published.
+type followUpJob struct {
+	kind    string
+	name    string
+	payload any
+}
+
+// finishUpload marks a published upload ready, queues the follow up work for
+// its version and removes it from staging. It's safe to run again for the
+// same version, since follow up jobs already queued for it are skipped.
+func (cfg *apiConfig) finishUpload(ctx context.Context, video database.Video, version database.VideoVersion, payload processUploadPayload) error {
+	err := cfg.setProcessingStatus(video.ID, database.ProcessingStatusReady, "")
+	if err != nil {
+		return err
+	}
+
+	followUps := []followUpJob{
+		{jobKindStoryboard, "storyboard", generateStoryboardPayload{VersionID: version.ID}},
+		{jobKindAudio, "audio", extractAudioPayload{VersionID: version.ID}},
+	}
+	if video.ThumbnailURL == nil {
+		followUps = append(followUps, followUpJob{jobKindPoster, "poster", generatePosterPayload{SourceKey: version.Key}})
+	}
+	// The MP4 is playable already, adaptive streaming follows in its own job
+	if cfg.streamingFormats.any() {
+		followUps = append(followUps, followUpJob{jobKindPackageVideo, "packaging", packageVideoPayload{VersionID: version.ID}})
+	}
+	for _, followUp := range followUps {
+		queued, err := cfg.db.HasJobSince(video.ID, followUp.kind, version.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if queued {
+			continue
+		}
+		_, err = cfg.enqueueJob(video.ID, followUp.kind, followUp.payload)
+		if err != nil {
+			log.Printf("Couldn't queue %s for video %s: %v", followUp.name, video.ID, err)
+		}
+	}
+
+	err = cfg.storage.Delete(ctx, payload.SourceKey)
+	if err != nil {
+		log.Printf("Couldn't delete staged upload %s: %v", payload.SourceKey, err)
+	}
+	return nil
+}
+
+func truncateJobError(err error) string {
+	msg := err.Error()
+	if len(msg) > jobMaxErrorBytes {
+		msg = msg[:jobMaxErrorBytes]
+	}
+	return msg
+}
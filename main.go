@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
-
-	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -26,10 +32,21 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
-	s3Client				*s3.Client
+	storageBackend   string
+	storage          storage.Store
+	assets           storage.Store
+	mediaBaseURL     string
+	uploadsRoot      string
+	uploadLocks      *uploadLocker
+	jobsReady        chan struct{}
+	progress         *progressHub
+	renditionLadder  []rendition
+	streamingFormats streamingFormats
+	// uploadContentTypes are the video types uploads may declare
+	uploadContentTypes contentTypeSet
+	ffmpeg             ffmpeg.Runner
 }
 
-
 func main() {
 	godotenv.Load(".env")
 
@@ -63,54 +80,155 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	uploadsRoot := os.Getenv("UPLOADS_ROOT")
+	if uploadsRoot == "" {
+		uploadsRoot = filepath.Join(os.TempDir(), "tubely-uploads")
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	renditionLadderSpec := os.Getenv("HLS_LADDER")
+	if renditionLadderSpec == "" {
+		renditionLadderSpec = defaultRenditionLadder
+	}
+	renditionLadder, err := parseRenditionLadder(renditionLadderSpec)
+	if err != nil {
+		log.Fatalf("Invalid HLS_LADDER: %v", err)
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	streamingFormatsSpec := os.Getenv("STREAMING_FORMATS")
+	if streamingFormatsSpec == "" {
+		streamingFormatsSpec = defaultStreamingFormats
+	}
+	streamingFormats, err := parseStreamingFormats(streamingFormatsSpec)
+	if err != nil {
+		log.Fatalf("Invalid STREAMING_FORMATS: %v", err)
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(
-		context.Background(),
-		config.WithRegion(s3Region),
-	)
+	uploadContentTypesSpec := os.Getenv("UPLOAD_CONTENT_TYPES")
+	if uploadContentTypesSpec == "" {
+		uploadContentTypesSpec = defaultUploadContentTypes
+	}
+	uploadContentTypes, err := parseUploadContentTypes(uploadContentTypesSpec)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Invalid UPLOAD_CONTENT_TYPES: %v", err)
+	}
+
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
 	}
-	
-	client := s3.NewFromConfig(awsCfg)
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		s3Client: 				client,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		db:                 db,
+		jwtSecret:          jwtSecret,
+		platform:           platform,
+		filepathRoot:       filepathRoot,
+		assetsRoot:         assetsRoot,
+		port:               port,
+		storageBackend:     storageBackend,
+		uploadsRoot:        uploadsRoot,
+		uploadLocks:        newUploadLocker(),
+		progress:           newProgressHub(),
+		jobsReady:          make(chan struct{}, 1),
+		renditionLadder:    renditionLadder,
+		streamingFormats:   streamingFormats,
+		uploadContentTypes: uploadContentTypes,
+		ffmpeg: ffmpeg.ExecRunner{
+			Timeout: time.Duration(getEnvInt("FFMPEG_TIMEOUT_MINUTES", 30)) * time.Minute,
+		},
+	}
+
+	switch storageBackend {
+	case "s3":
+		cfg.s3Bucket = os.Getenv("S3_BUCKET")
+		if cfg.s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		cfg.s3Region = os.Getenv("S3_REGION")
+		if cfg.s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+
+		cfg.s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if cfg.s3CfDistribution == "" {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
+
+		awsCfg, err := config.LoadDefaultConfig(
+			context.Background(),
+			config.WithRegion(cfg.s3Region),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cfg.storage = storage.NewS3Store(s3.NewFromConfig(awsCfg), cfg.s3Bucket, storage.S3Options{
+			PartSize:    int64(getEnvInt("S3_PART_SIZE_MB", 8)) << 20,
+			Concurrency: getEnvInt("S3_UPLOAD_CONCURRENCY", 4),
+			PartRetries: getEnvInt("S3_PART_RETRIES", 3),
+		})
+		cfg.mediaBaseURL = cfg.s3CfDistribution
+	case "local":
+		localStorageRoot := os.Getenv("LOCAL_STORAGE_ROOT")
+		if localStorageRoot == "" {
+			localStorageRoot = "./media"
+		}
+
+		cfg.storage, err = storage.NewLocalStore(localStorageRoot)
+		if err != nil {
+			log.Fatalf("Couldn't create local storage: %v", err)
+		}
+		cfg.mediaBaseURL = fmt.Sprintf("http://localhost:%s/media", port)
+	case "memory":
+		cfg.storage = storage.NewMemoryStore()
+		cfg.mediaBaseURL = fmt.Sprintf("http://localhost:%s/media", port)
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected s3, local or memory", storageBackend)
+	}
+
+	// MEDIA_BASE_URL is the public origin media is served from, e.g. a CDN
+	// hostname. It defaults to whatever the storage backend serves from.
+	if mediaBaseURL := os.Getenv("MEDIA_BASE_URL"); mediaBaseURL != "" {
+		cfg.mediaBaseURL = mediaBaseURL
 	}
+	cfg.mediaBaseURL = strings.TrimSuffix(cfg.mediaBaseURL, "/")
 
 	err = cfg.ensureAssetsDir()
 	if err != nil {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	cfg.assets, err = storage.NewLocalStore(assetsRoot)
+	if err != nil {
+		log.Fatalf("Couldn't open assets directory: %v", err)
+	}
+
+	err = os.MkdirAll(uploadsRoot, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create uploads directory: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		err = cfg.runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	go cfg.expireTusUploads(context.Background())
+	go cfg.sweepPendingDeletions(context.Background())
+
+	err = cfg.startJobWorkers(context.Background(), getEnvInt("WORKER_COUNT", 2))
+	if err != nil {
+		log.Fatalf("Couldn't start job workers: %v", err)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
@@ -118,6 +236,10 @@ func main() {
 	assetsHandler := http.StripPrefix("/assets/", http.FileServer(http.Dir(assetsRoot)))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
 
+	if storageBackend != "s3" {
+		mux.HandleFunc("GET /media/{key...}", cfg.handlerMedia)
+	}
+
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
@@ -127,9 +249,42 @@ func main() {
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/presign", cfg.handlerVideoUploadPresign)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/complete", cfg.handlerVideoUploadComplete)
+	mux.HandleFunc("OPTIONS /api/tus/", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/tus/{videoID}", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/tus/{videoID}/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/tus/{videoID}/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE /api/tus/{videoID}/{uploadID}", cfg.handlerTusDelete)
+	mux.HandleFunc("GET /api/jobs/{jobID}", cfg.handlerJobGet)
+	mux.HandleFunc("GET /api/podcast", cfg.handlerPodcastGet)
+	mux.HandleFunc("PUT /api/podcast", cfg.handlerPodcastUpdate)
+	mux.HandleFunc("DELETE /api/podcast", cfg.handlerPodcastDelete)
+	mux.HandleFunc("GET /api/branding", cfg.handlerBrandingGet)
+	mux.HandleFunc("PUT /api/branding/watermark", cfg.handlerBrandingWatermarkUpdate)
+	mux.HandleFunc("DELETE /api/branding/watermark", cfg.handlerBrandingWatermarkDelete)
+	mux.HandleFunc("PUT /api/branding/{bumper}", cfg.handlerBrandingBumperUpdate)
+	mux.HandleFunc("DELETE /api/branding/{bumper}", cfg.handlerBrandingBumperDelete)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/events", cfg.handlerVideoEvents)
+	mux.HandleFunc("GET /api/videos/{videoID}/captions", cfg.handlerCaptionsList)
+	mux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.handlerCaptionUpload)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{language}", cfg.handlerCaptionDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/chapters", cfg.handlerChaptersList)
+	mux.HandleFunc("POST /api/videos/{videoID}/chapters", cfg.handlerChapterCreate)
+	mux.HandleFunc("PUT /api/videos/{videoID}/chapters/{chapterID}", cfg.handlerChapterUpdate)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/chapters/{chapterID}", cfg.handlerChapterDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/clips", cfg.handlerClipCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/edits", cfg.handlerVideoEditsGet)
+	mux.HandleFunc("PUT /api/videos/{videoID}/edits", cfg.handlerVideoEditsUpdate)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/edits", cfg.handlerVideoEditsDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/poster", cfg.handlerVideoPosterRegenerate)
+	mux.HandleFunc("GET /api/videos/{videoID}/versions", cfg.handlerVideoVersionsList)
+	mux.HandleFunc("POST /api/videos/{videoID}/versions/{versionID}/restore", cfg.handlerVideoVersionRestore)
+
+	mux.HandleFunc("GET /feeds/{userID}/podcast.xml", cfg.handlerPodcastFeed)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
 
@@ -141,3 +296,17 @@ func main() {
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// getEnvInt reads an optional integer environment variable, falling back to
+// def when it isn't set.
+func getEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", name, err)
+	}
+	return n
+}
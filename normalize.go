@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"mime"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// defaultUploadContentTypes are the upload types accepted unless
+// UPLOAD_CONTENT_TYPES says otherwise. Anything ffmpeg can read would do,
+// since every upload is normalized before it's stored.
+const defaultUploadContentTypes = "video/mp4,video/quicktime,video/webm,video/x-matroska,image/gif"
+
+const (
+	// mezzanineMaxFrameRate caps the frame rate of transcoded uploads. GIFs in
+	// particular can claim silly base rates.
+	mezzanineMaxFrameRate     = 60
+	mezzanineDefaultFrameRate = 30
+	// frameRateTolerance is how far a stream's average frame rate can drift
+	// from its base rate, in frames per second, and still count as constant
+	frameRateTolerance = 0.05
+)
+
+// contentTypeSet is a set of accepted media types, without parameters.
+type contentTypeSet map[string]bool
+
+func parseUploadContentTypes(s string) (contentTypeSet, error) {
+	types := contentTypeSet{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %w", name, err)
+		}
+		types[mediaType] = true
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no content types given")
+	}
+	return types, nil
+}
+
+// allows reports whether a Content-Type header value is in the set,
+// ignoring any parameters.
+func (s contentTypeSet) allows(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return s[mediaType]
+}
+
+func (s contentTypeSet) String() string {
+	types := make([]string, 0, len(s))
+	for t := range s {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// normalizeVideo turns a raw upload into a faststart MP4 that plays in every
+// browser: H.264 video in yuv420p at a constant frame rate, with AAC audio.
+// Uploads that are already like that are only remuxed. onProgress is called
+// as a transcode goes. Any chapters are written into the MP4 on the way, and
+// uploads with branding are always transcoded (see brandVideo). chapterOffset
+// is where the video's own content starts in the result, and outroLength how
+// much of it comes after the content.
+func (cfg *apiConfig) normalizeVideo(ctx context.Context, upload rawUpload, onProgress func(fraction float64)) (path string, chapterOffset, outroLength float64, err error) {
+	rawPath := upload.path
+	source, err := cfg.runFFprobe(ctx, rawPath)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if upload.branding != nil {
+		return cfg.brandVideo(ctx, upload, source, onProgress)
+	}
+	video, ok := source.videoStream()
+	if !ok {
+		return "", 0, 0, fmt.Errorf("no video stream in upload")
+	}
+	audio, hasAudio := source.audioStream()
+	duration, _ := strconv.ParseFloat(source.Format.Duration, 64)
+
+	chaptersPath, err := writeChapterMetadata(rawPath, offsetChapters(upload.chapters, upload.chapterOffset), duration)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if chaptersPath != "" {
+		defer os.Remove(chaptersPath)
+	}
+
+	if isMezzanineCompatible(video, audio, hasAudio) {
+		streams := []int{video.Index}
+		if hasAudio {
+			streams = append(streams, audio.Index)
+		}
+		path, err := cfg.processVideoForFastStart(ctx, rawPath, chaptersPath, streams)
+		return path, upload.chapterOffset, upload.outroLength, err
+	}
+
+	outputPath := rawPath + ".processing"
+	args := append([]string{"-y", "-i", rawPath}, chapterMetadataArgs(chaptersPath, 1)...)
+	args = append(args,
+		"-map", fmt.Sprintf("0:%d", video.Index),
+		"-vf", fmt.Sprintf("fps=%g,scale=trunc(iw/2)*2:trunc(ih/2)*2,format=yuv420p", mezzanineFrameRate(video)),
+		"-c:v", "libx264", "-preset", "medium", "-crf", "20", "-profile:v", "high",
+	)
+	if hasAudio {
+		args = append(args, "-map", fmt.Sprintf("0:%d", audio.Index))
+		if audio.CodecName == "aac" {
+			args = append(args, "-c:a", "copy")
+		} else {
+			args = append(args, "-c:a", "aac", "-b:a", "128k")
+		}
+	}
+	args = append(args, "-movflags", "+faststart", "-f", "mp4", outputPath)
+
+	err = cfg.runFFmpegWithProgress(ctx, time.Duration(duration*float64(time.Second)), onProgress, args...)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("couldn't transcode upload: %w", err)
+	}
+	return outputPath, upload.chapterOffset, upload.outroLength, nil
+}
+
+// writeChapterMetadata writes chapters next to a raw upload as an FFMETADATA
+// file, returning its path, or "" if there are no chapters to write.
+func writeChapterMetadata(rawPath string, chapters []database.Chapter, duration float64) (string, error) {
+	metadata := buildChapterMetadata(chapters, duration)
+	if metadata == nil {
+		return "", nil
+	}
+	chaptersPath := rawPath + ".chapters"
+	err := os.WriteFile(chaptersPath, metadata, 0600)
+	if err != nil {
+		return "", fmt.Errorf("couldn't write chapters: %w", err)
+	}
+	return chaptersPath, nil
+}
+
+// chapterMetadataArgs adds an FFMETADATA file of chapters as the input after
+// the others, numbered input, and takes the output's chapters from it rather
+// than from the upload.
+func chapterMetadataArgs(chaptersPath string, input int) []string {
+	if chaptersPath == "" {
+		return nil
+	}
+	return []string{"-f", "ffmetadata", "-i", chaptersPath, "-map_chapters", strconv.Itoa(input)}
+}
+
+// isMezzanineCompatible reports whether streams can be copied into the stored
+// MP4 as they are. Any other streams in the upload are dropped.
+func isMezzanineCompatible(video, audio ffprobeStream, hasAudio bool) bool {
+	if video.CodecName != "h264" || video.PixelFormat != "yuv420p" {
+		return false
+	}
+	if hasAudio && audio.CodecName != "aac" {
+		return false
+	}
+	base := parseFrameRate(video.RFrameRate)
+	average := parseFrameRate(video.AvgFrameRate)
+	return base > 0 && math.Abs(base-average) <= frameRateTolerance
+}
+
+// mezzanineFrameRate picks the constant frame rate a video is transcoded at.
+func mezzanineFrameRate(video ffprobeStream) float64 {
+	rate := video.frameRate()
+	switch {
+	case rate <= 0:
+		return mezzanineDefaultFrameRate
+	case rate > mezzanineMaxFrameRate:
+		return mezzanineMaxFrameRate
+	default:
+		return rate
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+)
+
+// fakeFFmpeg answers ffprobe with probe and records the arguments of every
+// ffmpeg run in runs.
+func fakeFFmpeg(probe string, runs *[][]string) ffmpeg.Runner {
+	return ffmpeg.RunnerFunc(func(ctx context.Context, cmd ffmpeg.Command) error {
+		if cmd.Program == "ffprobe" {
+			_, err := io.WriteString(cmd.Stdout, probe)
+			return err
+		}
+		*runs = append(*runs, cmd.Args)
+		return nil
+	})
+}
+
+// mkvProbe is an MKV with subtitle and data streams after its video and
+// audio, which can't be copied into an MP4.
+const mkvProbe = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "%VIDEO%", "width": 1280, "height": 720, "pix_fmt": "yuv420p", "r_frame_rate": "30/1", "avg_frame_rate": "30/1"},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac", "channels": 2},
+		{"index": 2, "codec_type": "subtitle", "codec_name": "subrip"},
+		{"index": 3, "codec_type": "data", "codec_name": "bin_data"}
+	],
+	"format": {"format_name": "matroska,webm", "duration": "10.000000"}
+}`
+
+func TestNormalizeVideoMapsProbedStreams(t *testing.T) {
+	tests := []struct {
+		name       string
+		videoCodec string
+		wantArgs   []string
+	}{
+		{
+			name:       "remux",
+			videoCodec: "h264",
+			wantArgs:   []string{"-map", "0:0", "-map", "0:1", "-sn", "-dn", "-c", "copy"},
+		},
+		{
+			name:       "transcode",
+			videoCodec: "vp9",
+			wantArgs:   []string{"-map", "0:0", "-c:v", "libx264", "-map", "0:1", "-c:a", "copy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs [][]string
+			cfg := &apiConfig{ffmpeg: fakeFFmpeg(strings.ReplaceAll(mkvProbe, "%VIDEO%", tt.videoCodec), &runs)}
+			rawPath := filepath.Join(t.TempDir(), "upload.mkv")
+
+			path, _, _, err := cfg.normalizeVideo(context.Background(), rawUpload{path: rawPath}, func(float64) {})
+			if err != nil {
+				t.Fatalf("normalizeVideo returned error: %v", err)
+			}
+			if path != rawPath+".processing" {
+				t.Errorf("normalizeVideo() = %q, want %q", path, rawPath+".processing")
+			}
+			if len(runs) != 1 {
+				t.Fatalf("ffmpeg ran %d times, want 1", len(runs))
+			}
+
+			args := runs[0]
+			var maps []string
+			for i, arg := range args {
+				if arg == "-map" && i+1 < len(args) {
+					maps = append(maps, args[i+1])
+				}
+			}
+			if !slices.Equal(maps, []string{"0:0", "0:1"}) {
+				t.Errorf("ffmpeg mapped streams %v, want [0:0 0:1]; args: %v", maps, args)
+			}
+			if !containsInOrder(args, tt.wantArgs) {
+				t.Errorf("ffmpeg args %v don't include %v in order", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+// containsInOrder reports whether want appears in args as a subsequence.
+func containsInOrder(args, want []string) bool {
+	i := 0
+	for _, arg := range args {
+		if i < len(want) && arg == want[i] {
+			i++
+		}
+	}
+	return i == len(want)
+}
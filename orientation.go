@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Orientations double as the top level prefix processed videos are stored
+// under.
+const (
+	orientationLandscape = "landscape"
+	orientationPortrait  = "portrait"
+	orientationSquare    = "square"
+)
+
+// squareTolerance is how far from 1:1 a picture can be and still count as
+// square, so encoder padding like 1080x1088 doesn't tip it either way.
+const squareTolerance = 0.03
+
+// classifyOrientation works out how a video looks once a player has applied
+// its rotation and sample aspect ratio. The ratio is exact, reduced to lowest
+// terms, e.g. "16:9" or "4:3".
+func classifyOrientation(info database.MediaInfo) (orientation string, ratio string) {
+	if info.Width <= 0 || info.Height <= 0 {
+		return orientationLandscape, ""
+	}
+
+	// Scale the width by the sample aspect ratio, keeping whole numbers so
+	// the ratio can be reduced exactly
+	sarNum, sarDen := parseSampleAspectRatio(info.SampleAspectRatio)
+	displayWidth := int64(info.Width) * sarNum
+	displayHeight := int64(info.Height) * sarDen
+	if info.Rotation%180 == 90 {
+		displayWidth, displayHeight = displayHeight, displayWidth
+	}
+
+	divisor := gcd(displayWidth, displayHeight)
+	ratio = fmt.Sprintf("%d:%d", displayWidth/divisor, displayHeight/divisor)
+
+	aspect := float64(displayWidth) / float64(displayHeight)
+	switch {
+	case math.Abs(aspect-1) <= squareTolerance:
+		return orientationSquare, ratio
+	case aspect > 1:
+		return orientationLandscape, ratio
+	default:
+		return orientationPortrait, ratio
+	}
+}
+
+// displaySize is the size of a video's picture as players show it, after
+// rotation and sample aspect ratio, in whole even pixels. Renditions, edits
+// and storyboards are all measured against it.
+func displaySize(info database.MediaInfo) (int, int) {
+	sarNum, sarDen := parseSampleAspectRatio(info.SampleAspectRatio)
+	width := int(int64(info.Width)*sarNum/sarDen) / 2 * 2
+	height := info.Height / 2 * 2
+	if info.Rotation%180 == 90 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// parseSampleAspectRatio reads ffprobe's "num:den" sample aspect ratio. It
+// treats a missing or unknown ("0:1") ratio as square pixels.
+func parseSampleAspectRatio(sar string) (int64, int64) {
+	numStr, denStr, ok := strings.Cut(sar, ":")
+	if !ok {
+		return 1, 1
+	}
+	num, err1 := strconv.ParseInt(numStr, 10, 64)
+	den, err2 := strconv.ParseInt(denStr, 10, 64)
+	if err1 != nil || err2 != nil || num <= 0 || den <= 0 {
+		return 1, 1
+	}
+	return num, den
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
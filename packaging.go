@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRenditionLadder  = "1080:5000,720:2800,480:1400,240:400"
+	defaultStreamingFormats = "hls,dash"
+
+	// HLS and DASH share a segment length so both are cut on the same key
+	// frames
+	segmentSeconds      = 6
+	renditionAudioKbps  = 128
+	hlsMasterPlaylist   = "master.m3u8"
+	hlsMediaPlaylist    = "index.m3u8"
+	hlsPlaylistMimeType = "application/vnd.apple.mpegurl"
+	dashManifest        = "manifest.mpd"
+	dashManifestType    = "application/dash+xml"
+)
+
+// streamingFormats are the adaptive streaming outputs packaged for each
+// version.
+type streamingFormats struct {
+	HLS  bool
+	DASH bool
+}
+
+func (f streamingFormats) any() bool {
+	return f.HLS || f.DASH
+}
+
+// parseStreamingFormats reads a comma separated list such as "hls,dash". An
+// explicit "none" turns adaptive streaming off.
+func parseStreamingFormats(s string) (streamingFormats, error) {
+	formats := streamingFormats{}
+	for _, name := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "hls":
+			formats.HLS = true
+		case "dash":
+			formats.DASH = true
+		case "none":
+		default:
+			return streamingFormats{}, fmt.Errorf("unknown streaming format %q, expected hls, dash or none", name)
+		}
+	}
+	return formats, nil
+}
+
+// rendition is one rung of the adaptive bitrate ladder.
+type rendition struct {
+	// Height is the short side of the picture, so portrait videos get the
+	// same ladder as landscape ones
+	Height    int
+	VideoKbps int
+}
+
+// plannedRendition is a rendition scaled to a particular source video.
+type plannedRendition struct {
+	Name      string
+	Width     int
+	Height    int
+	VideoKbps int
+}
+
+// packageVideoPayload asks for a version to be packaged for adaptive
+// streaming.
+type packageVideoPayload struct {
+	VersionID uuid.UUID `json:"version_id"`
+}
+
+// parseRenditionLadder reads a ladder such as "1080:5000,720:2800", where
+// each rung is a short side in pixels and a video bitrate in kbps.
+func parseRenditionLadder(s string) ([]rendition, error) {
+	ladder := []rendition{}
+	for _, rung := range strings.Split(s, ",") {
+		heightStr, kbpsStr, ok := strings.Cut(strings.TrimSpace(rung), ":")
+		if !ok {
+			return nil, fmt.Errorf("rendition %q should look like height:kbps", rung)
+		}
+		height, err := strconv.Atoi(heightStr)
+		if err != nil || height <= 0 {
+			return nil, fmt.Errorf("rendition %q has an invalid height", rung)
+		}
+		kbps, err := strconv.Atoi(kbpsStr)
+		if err != nil || kbps <= 0 {
+			return nil, fmt.Errorf("rendition %q has an invalid bitrate", rung)
+		}
+		for _, existing := range ladder {
+			if existing.Height == height {
+				return nil, fmt.Errorf("rendition height %d is listed twice", height)
+			}
+		}
+		ladder = append(ladder, rendition{Height: height, VideoKbps: kbps})
+	}
+	sort.Slice(ladder, func(i, j int) bool {
+		return ladder[i].Height > ladder[j].Height
+	})
+	return ladder, nil
+}
+
+// planRenditions scales the ladder to a source's aspect ratio, skipping rungs
+// that would upscale it. A source smaller than every rung gets a single
+// rendition at its own size.
+func planRenditions(width, height int, ladder []rendition) []plannedRendition {
+	shortSide := min(width, height)
+	planned := []plannedRendition{}
+	for _, rung := range ladder {
+		if rung.Height > shortSide {
+			continue
+		}
+		scale := float64(rung.Height) / float64(shortSide)
+		planned = append(planned, plannedRendition{
+			Name:      fmt.Sprintf("%dp", rung.Height),
+			Width:     evenDimension(float64(width) * scale),
+			Height:    evenDimension(float64(height) * scale),
+			VideoKbps: rung.VideoKbps,
+		})
+	}
+	if len(planned) == 0 && len(ladder) > 0 {
+		smallest := ladder[len(ladder)-1]
+		planned = append(planned, plannedRendition{
+			Name:      fmt.Sprintf("%dp", evenDimension(float64(shortSide))),
+			Width:     evenDimension(float64(width)),
+			Height:    evenDimension(float64(height)),
+			VideoKbps: smallest.VideoKbps,
+		})
+	}
+	return planned
+}
+
+// evenDimension rounds to the nearest even number of pixels, since H.264
+// needs even dimensions for yuv420p.
+func evenDimension(n float64) int {
+	return max(2, int(math.Round(n/2))*2)
+}
+
+// packageVideo encodes a version into the rendition ladder, packages it in
+// each enabled streaming format under the version's asset prefix and makes it
+// playable.
+func (cfg *apiConfig) packageVideo(ctx context.Context, payload packageVideoPayload) error {
+	version, err := cfg.db.GetVideoVersion(payload.VersionID)
+	if err != nil {
+		return err
+	}
+	if version.ID == uuid.Nil {
+		// The video, and its versions, were deleted while the job waited
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp("", "tubely-package-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	sourcePath := filepath.Join(workDir, "source.mp4")
+	err = cfg.downloadObject(ctx, version.Key, sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't download version: %w", err)
+	}
+
+	source, err := cfg.probeMedia(ctx, sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't probe version: %w", err)
+	}
+	// ffmpeg rotates frames as it decodes them, so renditions are planned
+	// from the picture as it's shown rather than as it's stored
+	width, height := displaySize(source)
+	renditions := planRenditions(width, height, cfg.renditionLadder)
+
+	// Every format is packaged from the same encodes, so they only have to
+	// be made once
+	renditionPaths := make([]string, len(renditions))
+	for i, r := range renditions {
+		renditionPaths[i] = filepath.Join(workDir, r.Name+".mp4")
+		err = cfg.encodeRendition(ctx, sourcePath, renditionPaths[i], r)
+		if err != nil {
+			return fmt.Errorf("couldn't encode %s rendition: %w", r.Name, err)
+		}
+	}
+
+	prefix := getVersionAssetPrefix(version.VideoID, version.ID)
+	version.HLSKey = nil
+	version.DASHKey = nil
+
+	if cfg.streamingFormats.HLS {
+		hlsDir := filepath.Join(workDir, "hls")
+		err = cfg.packageHLS(ctx, renditions, renditionPaths, hlsDir)
+		if err != nil {
+			return fmt.Errorf("couldn't package hls: %w", err)
+		}
+		err = cfg.uploadDir(ctx, hlsDir, prefix+"hls/")
+		if err != nil {
+			return fmt.Errorf("couldn't upload hls: %w", err)
+		}
+		hlsKey := prefix + "hls/" + hlsMasterPlaylist
+		version.HLSKey = &hlsKey
+	}
+
+	if cfg.streamingFormats.DASH {
+		dashDir := filepath.Join(workDir, "dash")
+		err = cfg.packageDASH(ctx, renditionPaths, source.AudioCodec != "", dashDir)
+		if err != nil {
+			return fmt.Errorf("couldn't package dash: %w", err)
+		}
+		err = cfg.uploadDir(ctx, dashDir, prefix+"dash/")
+		if err != nil {
+			return fmt.Errorf("couldn't upload dash: %w", err)
+		}
+		dashKey := prefix + "dash/" + dashManifest
+		version.DASHKey = &dashKey
+	}
+
+	err = cfg.db.SetVideoVersionManifests(version.ID, version.HLSKey, version.DASHKey)
+	if err != nil {
+		return err
+	}
+
+	if version.HLSKey != nil {
+		captions, err := cfg.db.GetCaptions(version.VideoID)
+		if err != nil {
+			return err
+		}
+		if len(captions) > 0 {
+			err = cfg.writeHLSSubtitles(ctx, version, captions)
+			if err != nil {
+				return fmt.Errorf("couldn't add captions to hls: %w", err)
+			}
+		}
+	}
+
+	return cfg.refreshPlayback(version.ID)
+}
+
+// refreshPlayback updates a video's playback URLs after more of a version has
+// been processed, as long as it's still the version being played. The version
+// is reloaded since other jobs may have added to it in the meantime.
+func (cfg *apiConfig) refreshPlayback(versionID uuid.UUID) error {
+	version, err := cfg.db.GetVideoVersion(versionID)
+	if err != nil {
+		return err
+	}
+	video, err := cfg.db.GetVideo(version.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.VideoURL == nil || *video.VideoURL != cfg.getObjectURL(version.Key) {
+		return nil
+	}
+	return cfg.db.UpdateVideoPlayback(video.ID, cfg.getVersionPlayback(version))
+}
+
+// encodeRendition transcodes the source to a single rendition, with key frames
+// on segment boundaries so it can be packaged without re-encoding.
+func (cfg *apiConfig) encodeRendition(ctx context.Context, sourcePath, outputPath string, r plannedRendition) error {
+	return cfg.runFFmpeg(ctx,
+		"-y", "-i", sourcePath,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=%d:%d,setsar=1", r.Width, r.Height),
+		"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main", "-pix_fmt", "yuv420p",
+		"-b:v", fmt.Sprintf("%dk", r.VideoKbps),
+		"-maxrate", fmt.Sprintf("%dk", r.VideoKbps*107/100),
+		"-bufsize", fmt.Sprintf("%dk", r.VideoKbps*3/2),
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentSeconds),
+		"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", renditionAudioKbps), "-ac", "2",
+		"-movflags", "+faststart",
+		outputPath,
+	)
+}
+
+// packageHLS segments each rendition into its own media playlist and writes a
+// master playlist that lists them all.
+func (cfg *apiConfig) packageHLS(ctx context.Context, renditions []plannedRendition, renditionPaths []string, outputDir string) error {
+	for i, r := range renditions {
+		dir := filepath.Join(outputDir, r.Name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		err := cfg.runFFmpeg(ctx,
+			"-y", "-i", renditionPaths[i],
+			"-c", "copy",
+			"-f", "hls",
+			"-hls_time", strconv.Itoa(segmentSeconds),
+			"-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(dir, "segment_%03d.ts"),
+			filepath.Join(dir, hlsMediaPlaylist),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(outputDir, hlsMasterPlaylist), buildHLSMasterPlaylist(renditions), 0644)
+}
+
+func buildHLSMasterPlaylist(renditions []plannedRendition) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		bandwidth := (r.VideoKbps*107/100 + renditionAudioKbps) * 1000
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n", bandwidth, r.Width, r.Height)
+		fmt.Fprintf(&b, "%s/%s\n", r.Name, hlsMediaPlaylist)
+	}
+	return b.Bytes()
+}
+
+// hlsSubtitleGroup is the rendition group caption tracks are listed under in
+// master playlists.
+const hlsSubtitleGroup = "subs"
+
+// hlsSubtitleTrack is a caption track as listed in a master playlist.
+type hlsSubtitleTrack struct {
+	Name     string
+	Language string
+	URI      string
+}
+
+// withHLSSubtitles lists tracks in a master playlist, replacing any it
+// already lists.
+func withHLSSubtitles(master []byte, tracks []hlsSubtitleTrack) []byte {
+	// Quoted attribute values can't hold quotes or line breaks
+	quoteSafe := strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ")
+
+	var b bytes.Buffer
+	for _, line := range strings.Split(strings.TrimRight(string(master), "\n"), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA:TYPE=SUBTITLES,") {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			line = strings.ReplaceAll(line, `,SUBTITLES="`+hlsSubtitleGroup+`"`, "")
+			if len(tracks) > 0 {
+				line += `,SUBTITLES="` + hlsSubtitleGroup + `"`
+			}
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+
+		if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+			for _, track := range tracks {
+				fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\",LANGUAGE=\"%s\",DEFAULT=NO,AUTOSELECT=YES,URI=\"%s\"\n",
+					hlsSubtitleGroup, quoteSafe.Replace(track.Name), track.Language, track.URI)
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// buildHLSSubtitlePlaylist wraps a whole WebVTT file as the single segment of
+// a subtitle media playlist.
+func buildHLSSubtitlePlaylist(captionURL string, duration float64) []byte {
+	duration = max(duration, 1)
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(duration)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXTINF:%.3f,\n", duration)
+	fmt.Fprintf(&b, "%s\n", captionURL)
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.Bytes()
+}
+
+// updateHLSSubtitles points the master playlists of every packaged version of
+// a video at the video's current caption tracks.
+func (cfg *apiConfig) updateHLSSubtitles(ctx context.Context, videoID uuid.UUID) error {
+	captions, err := cfg.db.GetCaptions(videoID)
+	if err != nil {
+		return err
+	}
+	versions, err := cfg.db.GetVideoVersions(videoID)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.HLSKey == nil {
+			continue
+		}
+		err = cfg.writeHLSSubtitles(ctx, version, captions)
+		if err != nil {
+			return fmt.Errorf("couldn't update playlist of version %s: %w", version.ID, err)
+		}
+	}
+	return nil
+}
+
+// writeHLSSubtitles writes a subtitle media playlist for each caption next to
+// a version's master playlist, and lists them in it.
+func (cfg *apiConfig) writeHLSSubtitles(ctx context.Context, version database.VideoVersion, captions []database.Caption) error {
+	var probe videoProbe
+	if len(version.Probe) > 0 {
+		if err := json.Unmarshal(version.Probe, &probe); err != nil {
+			return fmt.Errorf("couldn't read version probe: %w", err)
+		}
+	}
+	var duration float64
+	if probe.MediaInfo != nil {
+		duration = probe.MediaInfo.Duration
+	}
+
+	hlsPrefix := path.Dir(*version.HLSKey) + "/"
+	tracks := make([]hlsSubtitleTrack, 0, len(captions))
+	for _, caption := range captions {
+		name := "subtitles_" + caption.Language + ".m3u8"
+		playlist := buildHLSSubtitlePlaylist(cfg.getObjectURL(caption.Key), duration)
+		err := cfg.storage.Put(ctx, hlsPrefix+name, bytes.NewReader(playlist), storage.PutOptions{
+			ContentType: hlsPlaylistMimeType,
+		})
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, hlsSubtitleTrack{
+			Name:     caption.Label,
+			Language: caption.Language,
+			URI:      name,
+		})
+	}
+
+	body, _, err := cfg.storage.Get(ctx, *version.HLSKey)
+	if err != nil {
+		return err
+	}
+	master, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	return cfg.storage.Put(ctx, *version.HLSKey, bytes.NewReader(withHLSSubtitles(master, tracks)), storage.PutOptions{
+		ContentType: hlsPlaylistMimeType,
+	})
+}
+
+// packageDASH muxes the renditions into a single MPD with fMP4 segments. The
+// video renditions form one adaptation set, and the audio, which is the same
+// in every rendition, is only taken from the first.
+func (cfg *apiConfig) packageDASH(ctx context.Context, renditionPaths []string, hasAudio bool, outputDir string) error {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	args := []string{"-y"}
+	for _, p := range renditionPaths {
+		args = append(args, "-i", p)
+	}
+	for i := range renditionPaths {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+	}
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(segmentSeconds),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		filepath.Join(outputDir, dashManifest),
+	)
+	return cfg.runFFmpeg(ctx, args...)
+}
+
+// uploadDir puts every file under dir into storage under prefix, keeping
+// their relative paths.
+func (cfg *apiConfig) uploadDir(ctx context.Context, dir, prefix string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		key := prefix + filepath.ToSlash(rel)
+		return cfg.storage.Put(ctx, key, f, storage.PutOptions{
+			ContentType: streamingContentType(key),
+		})
+	})
+}
+
+func streamingContentType(key string) string {
+	switch path.Ext(key) {
+	case ".m3u8":
+		return hlsPlaylistMimeType
+	case ".ts":
+		return "video/mp2t"
+	case ".mpd":
+		return dashManifestType
+	case ".m4s":
+		return "video/iso.segment"
+	case ".vtt":
+		return "text/vtt"
+	case ".jpg":
+		return "image/jpeg"
+	case ".mp4":
+		return "video/mp4"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// downloadObject copies an object from storage to a file on disk.
+func (cfg *apiConfig) downloadObject(ctx context.Context, key, destPath string) error {
+	body, _, err := cfg.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, body); err != nil {
+		return err
+	}
+	return f.Close()
+}
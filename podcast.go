@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	maxPodcastTitleLength       = 255
+	maxPodcastDescriptionLength = 4000
+	podcastDefaultLanguage      = "en"
+	itunesNamespace             = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	// podcastEnclosureType is the type Apple Podcasts lists for M4A audio
+	podcastEnclosureType = "audio/x-m4a"
+)
+
+// podcastRSS is an RSS 2.0 feed with the iTunes tags podcast apps read.
+// encoding/xml doesn't do namespace prefixes, so the itunes: tags are
+// spelled out in full.
+type podcastRSS struct {
+	XMLName     xml.Name       `xml:"rss"`
+	Version     string         `xml:"version,attr"`
+	ITunesXMLNS string         `xml:"xmlns:itunes,attr"`
+	Channel     podcastChannel `xml:"channel"`
+}
+
+type podcastChannel struct {
+	Title       string          `xml:"title"`
+	Link        string          `xml:"link"`
+	Description string          `xml:"description"`
+	Language    string          `xml:"language"`
+	Author      string          `xml:"itunes:author,omitempty"`
+	Summary     string          `xml:"itunes:summary,omitempty"`
+	Explicit    string          `xml:"itunes:explicit"`
+	Category    *itunesCategory `xml:"itunes:category"`
+	Image       *itunesImage    `xml:"itunes:image"`
+	Items       []podcastItem   `xml:"item"`
+}
+
+type itunesCategory struct {
+	Text string `xml:"text,attr"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type podcastItem struct {
+	Title       string           `xml:"title"`
+	Description string           `xml:"description"`
+	GUID        podcastGUID      `xml:"guid"`
+	PubDate     string           `xml:"pubDate"`
+	Enclosure   podcastEnclosure `xml:"enclosure"`
+	Duration    int64            `xml:"itunes:duration,omitempty"`
+	Image       *itunesImage     `xml:"itunes:image"`
+}
+
+type podcastGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type podcastEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// buildPodcastFeed lists a user's videos that have an audio rendition as
+// episodes, newest first, with each video's thumbnail as its art. The newest
+// thumbnail stands in for the show's art.
+func buildPodcastFeed(podcast database.Podcast, videos []database.Video, link string) ([]byte, error) {
+	channel := podcastChannel{
+		Title:       podcast.Title,
+		Link:        link,
+		Description: podcast.Description,
+		Language:    podcast.Language,
+		Author:      podcast.Author,
+		Summary:     podcast.Description,
+		Explicit:    fmt.Sprint(podcast.Explicit),
+		Items:       []podcastItem{},
+	}
+	if channel.Language == "" {
+		channel.Language = podcastDefaultLanguage
+	}
+	if podcast.Category != "" {
+		channel.Category = &itunesCategory{Text: podcast.Category}
+	}
+
+	for _, video := range videos {
+		if video.AudioURL == nil {
+			continue
+		}
+		item := podcastItem{
+			Title:       video.Title,
+			Description: video.Description,
+			GUID:        podcastGUID{Value: video.ID.String()},
+			PubDate:     video.CreatedAt.UTC().Format(time.RFC1123Z),
+			Enclosure: podcastEnclosure{
+				URL:    *video.AudioURL,
+				Length: video.AudioSize,
+				Type:   podcastEnclosureType,
+			},
+		}
+		if video.MediaInfo != nil {
+			item.Duration = int64(math.Round(video.MediaInfo.Duration))
+		}
+		if video.ThumbnailURL != nil {
+			item.Image = &itunesImage{Href: *video.ThumbnailURL}
+			if channel.Image == nil {
+				channel.Image = item.Image
+			}
+		}
+		channel.Items = append(channel.Items, item)
+	}
+
+	data, err := xml.MarshalIndent(podcastRSS{
+		Version:     "2.0",
+		ITunesXMLNS: itunesNamespace,
+		Channel:     channel,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ffmpeg"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	// posterBlackScanSeconds is how far into a video we look for the end of
+	// a fade in before picking a poster frame
+	posterBlackScanSeconds = 30
+	posterDefaultOffset    = 1.0
+	posterMaxWidth         = 1280
+)
+
+// generatePosterPayload asks for a poster frame to be pulled from a stored
+// video file. Without a timestamp a representative frame is picked.
+type generatePosterPayload struct {
+	SourceKey string   `json:"source_key"`
+	Timestamp *float64 `json:"timestamp,omitempty"`
+	// Replace overwrites an existing thumbnail rather than only filling in a
+	// missing one
+	Replace bool `json:"replace"`
+}
+
+var blackEndPattern = regexp.MustCompile(`black_start:([0-9.]+) black_end:([0-9.]+)`)
+
+// generatePoster extracts a poster from a video file and stores it with the
+// video's thumbnails.
+func (cfg *apiConfig) generatePoster(ctx context.Context, videoID uuid.UUID, payload generatePosterPayload) error {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return nil
+	}
+	if !payload.Replace && video.ThumbnailURL != nil {
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp("", "tubely-poster-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	sourcePath := filepath.Join(workDir, "source.mp4")
+	err = cfg.downloadObject(ctx, payload.SourceKey, sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't download video: %w", err)
+	}
+
+	var timestamp float64
+	if payload.Timestamp != nil {
+		timestamp = *payload.Timestamp
+	} else {
+		timestamp, err = cfg.findPosterStart(ctx, sourcePath)
+		if err != nil {
+			return fmt.Errorf("couldn't scan for black frames: %w", err)
+		}
+	}
+
+	posterPath := filepath.Join(workDir, "poster.jpg")
+	data, err := cfg.extractFrame(ctx, sourcePath, posterPath, timestamp, payload.Timestamp == nil)
+	if errors.Is(err, errNoFrame) && payload.Timestamp == nil && timestamp > 0 {
+		// Very short videos end before the default offset
+		data, err = cfg.extractFrame(ctx, sourcePath, posterPath, 0, true)
+	}
+	if errors.Is(err, errNoFrame) {
+		return fmt.Errorf("no frame at %.3fs, it may be past the end of the video", timestamp)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't extract poster: %w", err)
+	}
+
+	key := getThumbnailKey(videoID, data, "image/jpeg")
+	err = cfg.storage.Put(ctx, key, bytes.NewReader(data), storage.PutOptions{
+		ContentType: "image/jpeg",
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't store poster: %w", err)
+	}
+
+	if payload.Replace {
+		return cfg.db.UpdateVideoThumbnailURL(videoID, cfg.getObjectURL(key))
+	}
+	// An uploaded thumbnail may have arrived while this ran, and wins
+	_, err = cfg.db.FillVideoThumbnailURL(videoID, cfg.getObjectURL(key))
+	return err
+}
+
+// findPosterStart returns the first moment after any black frames at the
+// start of a video, such as a fade in or a blank title card.
+func (cfg *apiConfig) findPosterStart(ctx context.Context, sourcePath string) (float64, error) {
+	// blackdetect reports at info level, so this can't go through runFFmpeg
+	var stderr bytes.Buffer
+	err := cfg.ffmpeg.Run(ctx, ffmpeg.Command{
+		Program: "ffmpeg",
+		Args: []string{
+			"-hide_banner", "-nostats",
+			"-t", strconv.Itoa(posterBlackScanSeconds),
+			"-i", sourcePath,
+			"-an",
+			"-vf", "blackdetect=d=0.1:pix_th=0.10",
+			"-f", "null", "-",
+		},
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Only a black stretch that starts the video matters, one in the middle
+	// doesn't stop an early frame being a good poster
+	start := posterDefaultOffset
+	for _, match := range blackEndPattern.FindAllStringSubmatch(stderr.String(), -1) {
+		blackStart, _ := strconv.ParseFloat(match[1], 64)
+		blackEnd, _ := strconv.ParseFloat(match[2], 64)
+		if blackStart > start {
+			break
+		}
+		start = max(start, blackEnd+0.5)
+	}
+	return start, nil
+}
+
+var errNoFrame = errors.New("no frame extracted")
+
+// extractFrame grabs the frame at a timestamp as a JPEG. With pick set,
+// ffmpeg's thumbnail filter chooses the most representative of the frames
+// that follow instead of taking the first one.
+func (cfg *apiConfig) extractFrame(ctx context.Context, sourcePath, outputPath string, timestamp float64, pick bool) ([]byte, error) {
+	filter := fmt.Sprintf("scale='min(%d,iw)':-2", posterMaxWidth)
+	if pick {
+		filter = "thumbnail=100," + filter
+	}
+	err := cfg.runFFmpeg(ctx,
+		"-y",
+		"-ss", strconv.FormatFloat(timestamp, 'f', 3, 64),
+		"-i", sourcePath,
+		"-vf", filter,
+		"-frames:v", "1",
+		"-q:v", "3",
+		outputPath,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Seeking past the end isn't an error to ffmpeg, it just writes nothing
+	data, err := os.ReadFile(outputPath)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && len(data) == 0) {
+		return nil, errNoFrame
+	}
+	return data, err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// ffprobeOutput is the subset of `ffprobe -show_format -show_streams` we use.
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+type ffprobeStream struct {
+	Index             int    `json:"index"`
+	CodecType         string `json:"codec_type"`
+	CodecName         string `json:"codec_name"`
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	SampleAspectRatio string `json:"sample_aspect_ratio"`
+	PixelFormat       string `json:"pix_fmt"`
+	AvgFrameRate      string `json:"avg_frame_rate"`
+	RFrameRate        string `json:"r_frame_rate"`
+	Channels          int    `json:"channels"`
+	ChannelLayout     string `json:"channel_layout"`
+	Tags              struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+	Disposition struct {
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+	SideDataList []struct {
+		SideDataType string  `json:"side_data_type"`
+		Rotation     float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// probeMedia runs ffprobe over a file and summarises its container and main
+// video and audio streams.
+func (cfg *apiConfig) probeMedia(ctx context.Context, filePath string) (database.MediaInfo, error) {
+	output, err := cfg.runFFprobe(ctx, filePath)
+	if err != nil {
+		return database.MediaInfo{}, err
+	}
+
+	info := database.MediaInfo{
+		Container: output.Format.FormatName,
+	}
+	info.Duration, _ = strconv.ParseFloat(output.Format.Duration, 64)
+	info.BitRate, _ = strconv.ParseInt(output.Format.BitRate, 10, 64)
+
+	video, ok := output.videoStream()
+	if !ok || video.Width == 0 || video.Height == 0 {
+		return database.MediaInfo{}, fmt.Errorf("no video stream in %s", filePath)
+	}
+	info.VideoCodec = video.CodecName
+	info.Width = video.Width
+	info.Height = video.Height
+	info.FrameRate = video.frameRate()
+	info.Rotation = video.rotation()
+	info.SampleAspectRatio = video.SampleAspectRatio
+
+	if audio, ok := output.audioStream(); ok {
+		info.AudioCodec = audio.CodecName
+		info.AudioChannels = audio.Channels
+		info.AudioChannelLayout = audio.ChannelLayout
+	}
+
+	info.Orientation, info.AspectRatio = classifyOrientation(info)
+	return info, nil
+}
+
+// videoStream returns the first video stream, which needn't be the first
+// stream in the file. Cover art is stored as a video stream too, and is
+// skipped.
+func (o ffprobeOutput) videoStream() (ffprobeStream, bool) {
+	for _, stream := range o.Streams {
+		if stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 {
+			return stream, true
+		}
+	}
+	return ffprobeStream{}, false
+}
+
+// audioStream returns the first audio stream.
+func (o ffprobeOutput) audioStream() (ffprobeStream, bool) {
+	for _, stream := range o.Streams {
+		if stream.CodecType == "audio" {
+			return stream, true
+		}
+	}
+	return ffprobeStream{}, false
+}
+
+// frameRate is the stream's average frame rate, or its base rate when the
+// average isn't known.
+func (s ffprobeStream) frameRate() float64 {
+	if rate := parseFrameRate(s.AvgFrameRate); rate > 0 {
+		return rate
+	}
+	return parseFrameRate(s.RFrameRate)
+}
+
+// rotation returns how far players turn the picture clockwise on display,
+// from the display matrix if there is one, or the older rotate tag.
+func (s ffprobeStream) rotation() int {
+	degrees := 0.0
+	if rotate, err := strconv.ParseFloat(s.Tags.Rotate, 64); err == nil {
+		degrees = rotate
+	}
+	for _, sideData := range s.SideDataList {
+		if sideData.SideDataType == "Display Matrix" {
+			// The display matrix angle is counterclockwise
+			degrees = -sideData.Rotation
+		}
+	}
+	return (int(math.Round(degrees))%360 + 360) % 360
+}
+
+// parseFrameRate reads ffprobe's rational frame rates, such as "30000/1001".
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(rate, 64)
+		return f
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return math.Round(n/d*1000) / 1000
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Stages of processing an upload, in the order they run.
+const (
+	progressStageDownloading = "downloading"
+	progressStageTranscoding = "transcoding"
+	progressStageUploading   = "uploading"
+)
+
+const (
+	// progressMinInterval and progressMinStep keep fast stages from flooding
+	// subscribers: an update is only sent once either has passed
+	progressMinInterval = time.Second
+	progressMinStep     = 1.0
+	progressBufferSize  = 16
+)
+
+// progressEvent is sent to anyone watching a video's processing. Stage and
+// Percent describe the step in progress while Status is processing.
+type progressEvent struct {
+	Status     database.ProcessingStatus `json:"status"`
+	Stage      string                    `json:"stage,omitempty"`
+	Percent    float64                   `json:"percent"`
+	ETASeconds *float64                  `json:"eta_seconds,omitempty"`
+	Error      string                    `json:"error,omitempty"`
+}
+
+// final reports whether nothing more will happen until another upload.
+func (e progressEvent) final() bool {
+	return e.Status == database.ProcessingStatusReady || e.Status == database.ProcessingStatusFailed
+}
+
+// progressHub fans progress events out to subscribers, per video. It only
+// knows about work done by this process.
+type progressHub struct {
+	mu          sync.Mutex
+	subscribers map[uuid.UUID]map[chan progressEvent]bool
+	// latest is the last event for videos still being processed
+	latest map[uuid.UUID]progressEvent
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{
+		subscribers: map[uuid.UUID]map[chan progressEvent]bool{},
+		latest:      map[uuid.UUID]progressEvent{},
+	}
+}
+
+// subscribe starts delivering a video's events. It also returns the last
+// event for a video that's being processed, if there is one.
+func (h *progressHub) subscribe(videoID uuid.UUID) (events <-chan progressEvent, latest progressEvent, ok bool, unsubscribe func()) {
+	ch := make(chan progressEvent, progressBufferSize)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[videoID] == nil {
+		h.subscribers[videoID] = map[chan progressEvent]bool{}
+	}
+	h.subscribers[videoID][ch] = true
+	latest, ok = h.latest[videoID]
+
+	return ch, latest, ok, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[videoID], ch)
+		if len(h.subscribers[videoID]) == 0 {
+			delete(h.subscribers, videoID)
+		}
+	}
+}
+
+func (h *progressHub) publish(videoID uuid.UUID, event progressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if event.final() {
+		delete(h.latest, videoID)
+	} else {
+		h.latest[videoID] = event
+	}
+
+	for ch := range h.subscribers[videoID] {
+		select {
+		case ch <- event:
+		default:
+			// A slow subscriber only needs the newest events, so make room by
+			// dropping its oldest. We're the only sender, so this can't block.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- event
+		}
+	}
+}
+
+// setProcessingStatus records a video's processing status and tells anyone
+// watching. errMsg explains a failure.
+func (cfg *apiConfig) setProcessingStatus(videoID uuid.UUID, status database.ProcessingStatus, errMsg string) error {
+	err := cfg.db.UpdateVideoProcessingStatus(videoID, status)
+	if err != nil {
+		return err
+	}
+	event := progressEvent{Status: status, Error: errMsg}
+	if status == database.ProcessingStatusReady {
+		event.Percent = 100
+	}
+	cfg.progress.publish(videoID, event)
+	return nil
+}
+
+// videoProgress reports the progress of processing one video, a stage at a
+// time. A nil *videoProgress reports nothing.
+type videoProgress struct {
+	hub     *progressHub
+	videoID uuid.UUID
+
+	mu            sync.Mutex
+	stage         string
+	started       time.Time
+	lastPublished time.Time
+	lastPercent   float64
+}
+
+func (cfg *apiConfig) newVideoProgress(videoID uuid.UUID) *videoProgress {
+	return &videoProgress{hub: cfg.progress, videoID: videoID}
+}
+
+// startStage moves on to the next stage, at 0%.
+func (p *videoProgress) startStage(stage string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stage = stage
+	p.started = time.Now()
+	p.publish(0)
+}
+
+// update reports how far through the current stage processing is, as a
+// fraction between 0 and 1.
+func (p *videoProgress) update(fraction float64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	percent := math.Round(fraction*1000) / 10
+	if percent == p.lastPercent {
+		return
+	}
+	if percent < 100 && percent-p.lastPercent < progressMinStep && time.Since(p.lastPublished) < progressMinInterval {
+		return
+	}
+	p.publish(percent)
+}
+
+// byteProgress adapts update for transfers of size bytes, such as
+// storage.PutOptions.Progress.
+func (p *videoProgress) byteProgress(size int64) func(transferred int64) {
+	if p == nil || size <= 0 {
+		return nil
+	}
+	return func(transferred int64) {
+		p.update(float64(transferred) / float64(size))
+	}
+}
+
+func (p *videoProgress) publish(percent float64) {
+	event := progressEvent{
+		Status:  database.ProcessingStatusProcessing,
+		Stage:   p.stage,
+		Percent: percent,
+	}
+	// Only estimate once there's enough to go on
+	if percent >= 1 && percent < 100 {
+		elapsed := time.Since(p.started).Seconds()
+		eta := math.Round(elapsed * (100 - percent) / percent)
+		event.ETASeconds = &eta
+	}
+	p.hub.publish(p.videoID, event)
+	p.lastPublished = time.Now()
+	p.lastPercent = percent
+}
+
+// progressReader calls onRead with the running total of bytes read through
+// it.
+type progressReader struct {
+	r      io.Reader
+	n      int64
+	onRead func(total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.onRead != nil {
+		p.n += int64(n)
+		p.onRead(p.n)
+	}
+	return n, err
+}
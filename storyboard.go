@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	storyboardInterval   = 5 * time.Second
+	storyboardTileWidth  = 160
+	storyboardColumns    = 10
+	storyboardRows       = 10
+	storyboardTrack      = "storyboard.vtt"
+	storyboardSpriteName = "sprite_%03d.jpg"
+)
+
+// generateStoryboardPayload asks for seek preview sprites to be made for a
+// version.
+type generateStoryboardPayload struct {
+	VersionID uuid.UUID `json:"version_id"`
+}
+
+// generateStoryboard samples a version every storyboardInterval into tiled
+// sprite sheets, with a WebVTT track pointing each stretch of time at its
+// tile.
+func (cfg *apiConfig) generateStoryboard(ctx context.Context, payload generateStoryboardPayload) error {
+	version, err := cfg.db.GetVideoVersion(payload.VersionID)
+	if err != nil {
+		return err
+	}
+	if version.ID == uuid.Nil {
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp("", "tubely-storyboard-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	sourcePath := filepath.Join(workDir, "source.mp4")
+	err = cfg.downloadObject(ctx, version.Key, sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't download version: %w", err)
+	}
+
+	source, err := cfg.probeMedia(ctx, sourcePath)
+	if err != nil {
+		return fmt.Errorf("couldn't probe version: %w", err)
+	}
+	if source.Duration <= 0 {
+		return fmt.Errorf("couldn't tell how long the video is")
+	}
+
+	// Tiles are cut from frames after ffmpeg has rotated them, so they take
+	// the shape of the picture as it's shown
+	width, height := displaySize(source)
+	tileWidth := storyboardTileWidth
+	tileHeight := evenDimension(float64(tileWidth) * float64(height) / float64(width))
+
+	outputDir := filepath.Join(workDir, "storyboard")
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	err = cfg.runFFmpeg(ctx,
+		"-y", "-i", sourcePath,
+		"-an",
+		"-vf", fmt.Sprintf("fps=1/%g,scale=%d:%d,setsar=1,tile=%dx%d",
+			storyboardInterval.Seconds(), tileWidth, tileHeight, storyboardColumns, storyboardRows),
+		"-q:v", "5",
+		filepath.Join(outputDir, storyboardSpriteName),
+	)
+	if err != nil {
+		return fmt.Errorf("couldn't render sprites: %w", err)
+	}
+
+	track := buildStoryboardTrack(source.Duration, tileWidth, tileHeight)
+	err = os.WriteFile(filepath.Join(outputDir, storyboardTrack), track, 0644)
+	if err != nil {
+		return err
+	}
+
+	prefix := getVersionAssetPrefix(version.VideoID, version.ID) + "storyboard/"
+	err = cfg.uploadDir(ctx, outputDir, prefix)
+	if err != nil {
+		return fmt.Errorf("couldn't upload storyboard: %w", err)
+	}
+
+	key := prefix + storyboardTrack
+	err = cfg.db.SetVideoVersionStoryboardKey(version.ID, key)
+	if err != nil {
+		return err
+	}
+
+	return cfg.refreshPlayback(version.ID)
+}
+
+// buildStoryboardTrack writes one cue per sampled frame, pointing at its tile
+// with a media fragment. Sprite URLs are relative to the track.
+func buildStoryboardTrack(duration float64, tileWidth, tileHeight int) []byte {
+	interval := storyboardInterval.Seconds()
+	frames := int(math.Ceil(duration / interval))
+	perSheet := storyboardColumns * storyboardRows
+
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < frames; i++ {
+		start := float64(i) * interval
+		end := math.Min(start+interval, duration)
+		tile := i % perSheet
+		fmt.Fprintf(&b, "\n%s --> %s\n", formatVTTTimestamp(start), formatVTTTimestamp(end))
+		fmt.Fprintf(&b, storyboardSpriteName+"#xywh=%d,%d,%d,%d\n",
+			i/perSheet+1,
+			(tile%storyboardColumns)*tileWidth,
+			(tile/storyboardColumns)*tileHeight,
+			tileWidth,
+			tileHeight,
+		)
+	}
+	return b.Bytes()
+}
+
+// formatVTTTimestamp formats seconds as a WebVTT hh:mm:ss.ttt timestamp.
+func formatVTTTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
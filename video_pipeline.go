@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// rawUpload is an uploaded video file sitting on disk, waiting to be published.
+type rawUpload struct {
+	path string
+	// sha256 is the hex digest of the file, computed from path if empty
+	sha256     string
+	uploaderID uuid.UUID
+	// progress, if set, is told how processing is going
+	progress *videoProgress
+	// chapters are written into the processed file
+	chapters []database.Chapter
+	// editedFromID and edits record how the file was rendered from another
+	// version, if it was
+	editedFromID *uuid.UUID
+	edits        json.RawMessage
+	// branding, if set, is put on the video while it's processed
+	branding *database.Branding
+	// chapterOffset is where the video's own content starts in the file, in
+	// seconds, if it was rendered from a version with an intro in front
+	chapterOffset float64
+	// outroLength is how much of the file comes after the video's own
+	// content, for the same reason
+	outroLength float64
+	// sourceKey is the staged upload the file came from, if it was staged
+	sourceKey string
+}
+
+// blobHash identifies the processed file an upload turns into. Chapters and
+// branding are part of the file, so uploads of the same video with different
+// ones can't share one.
+func (u rawUpload) blobHash() string {
+	if len(u.chapters) == 0 && u.branding == nil && u.chapterOffset == 0 {
+		return u.sha256
+	}
+	hasher := sha256.New()
+	io.WriteString(hasher, u.sha256)
+	for _, chapter := range u.chapters {
+		fmt.Fprintf(hasher, "\n%g\t%s", chapter.StartTime, chapter.Title)
+	}
+	if u.branding != nil {
+		writeBrandingFingerprint(hasher, *u.branding)
+	}
+	if u.chapterOffset != 0 {
+		fmt.Fprintf(hasher, "\noffset\t%g", u.chapterOffset)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// videoProbe is what we learn about a video file while processing it. It's
+// kept with each version, and MediaInfo is nil for versions processed before
+// it was recorded.
+type videoProbe struct {
+	AspectRatio string              `json:"aspect_ratio"`
+	MediaInfo   *database.MediaInfo `json:"media_info,omitempty"`
+	// ChapterOffset is where the video's own content starts, in seconds,
+	// after any intro it was branded with. Chapters are shifted by it.
+	ChapterOffset float64 `json:"chapter_offset,omitempty"`
+	// OutroLength is how long the outro after the video's own content is, in
+	// seconds. Chapters must start before it.
+	OutroLength float64 `json:"outro_length,omitempty"`
+}
+
+// storedVideo is a processed video file in the storage backend.
+type storedVideo struct {
+	key   string
+	size  int64
+	probe json.RawMessage
+}
+
+// publishVideo stores a raw upload (see storeVideoBlob), records it as a new
+// version of the video and makes that version current.
+func (cfg *apiConfig) publishVideo(ctx context.Context, video database.Video, upload rawUpload) (database.VideoVersion, error) {
+	if upload.sha256 == "" {
+		var err error
+		upload.sha256, err = hashFile(upload.path)
+		if err != nil {
+			return database.VideoVersion{}, fmt.Errorf("couldn't hash upload: %w", err)
+		}
+	}
+
+	stored, err := cfg.storeVideoBlob(ctx, upload)
+	if err != nil {
+		return database.VideoVersion{}, err
+	}
+
+	stored.probe, err = cfg.ensureMediaInfo(ctx, stored.probe, upload.path)
+	if err != nil {
+		cfg.releaseVideoObject(ctx, stored.key)
+		return database.VideoVersion{}, fmt.Errorf("couldn't probe upload: %w", err)
+	}
+
+	err = cfg.recordUnversionedFile(ctx, video)
+	if err != nil {
+		cfg.releaseVideoObject(ctx, stored.key)
+		return database.VideoVersion{}, fmt.Errorf("couldn't record previous version: %w", err)
+	}
+
+	var sourceKey *string
+	if upload.sourceKey != "" {
+		sourceKey = &upload.sourceKey
+	}
+	version, err := cfg.db.CreateVideoVersion(database.CreateVideoVersionParams{
+		VideoID:      video.ID,
+		Key:          stored.key,
+		Size:         stored.size,
+		SHA256:       upload.sha256,
+		Probe:        stored.probe,
+		UploaderID:   upload.uploaderID,
+		EditedFromID: upload.editedFromID,
+		Edits:        upload.edits,
+		SourceKey:    sourceKey,
+	})
+	if err != nil {
+		cfg.releaseVideoObject(ctx, stored.key)
+		return database.VideoVersion{}, fmt.Errorf("couldn't record version: %w", err)
+	}
+
+	err = cfg.makeVersionCurrent(ctx, version)
+	if err != nil {
+		return database.VideoVersion{}, err
+	}
+	return version, nil
+}
+
+// makeVersionCurrent points a video's playback URLs and media info at one of
+// its versions, and republishes its chapters to fit.
+func (cfg *apiConfig) makeVersionCurrent(ctx context.Context, version database.VideoVersion) error {
+	err := cfg.db.UpdateVideoPlayback(version.VideoID, cfg.getVersionPlayback(version))
+	if err != nil {
+		return fmt.Errorf("couldn't update video url: %w", err)
+	}
+
+	var probe videoProbe
+	if len(version.Probe) > 0 {
+		if err := json.Unmarshal(version.Probe, &probe); err != nil {
+			return fmt.Errorf("couldn't read version probe: %w", err)
+		}
+	}
+	err = cfg.db.UpdateVideoMediaInfo(version.VideoID, probe.MediaInfo)
+	if err != nil {
+		return fmt.Errorf("couldn't update media info: %w", err)
+	}
+
+	// The video plays fine without its chapters track
+	err = cfg.publishChapters(ctx, version.VideoID)
+	if err != nil {
+		log.Printf("Couldn't publish chapters for video %s: %v", version.VideoID, err)
+	}
+	return nil
+}
+
+// ensureMediaInfo fills in the media info on probe data borrowed from a
+// version that was processed before it was recorded, by probing the upload.
+func (cfg *apiConfig) ensureMediaInfo(ctx context.Context, probeData json.RawMessage, uploadPath string) (json.RawMessage, error) {
+	var probe videoProbe
+	if len(probeData) > 0 {
+		if err := json.Unmarshal(probeData, &probe); err != nil {
+			return nil, err
+		}
+	}
+	if probe.MediaInfo != nil {
+		return probeData, nil
+	}
+
+	info, err := cfg.probeMedia(ctx, uploadPath)
+	if err != nil {
+		return nil, err
+	}
+	probe.MediaInfo = &info
+	return json.Marshal(probe)
+}
+
+// getVersionPlayback is what a video plays once version is made current.
+func (cfg *apiConfig) getVersionPlayback(version database.VideoVersion) database.VideoPlayback {
+	videoURL := cfg.getObjectURL(version.Key)
+	playback := database.VideoPlayback{VideoURL: &videoURL}
+	if version.HLSKey != nil {
+		hlsURL := cfg.getObjectURL(*version.HLSKey)
+		playback.HLSURL = &hlsURL
+	}
+	if version.DASHKey != nil {
+		dashURL := cfg.getObjectURL(*version.DASHKey)
+		playback.DASHURL = &dashURL
+	}
+	if version.StoryboardKey != nil {
+		storyboardURL := cfg.getObjectURL(*version.StoryboardKey)
+		playback.StoryboardURL = &storyboardURL
+	}
+	if version.AudioKey != nil {
+		audioURL := cfg.getObjectURL(*version.AudioKey)
+		playback.AudioURL = &audioURL
+		playback.AudioSize = version.AudioSize
+	}
+	return playback
+}
+
+// recordUnversionedFile adds a version for a video's current file if it was
+// uploaded before version history existed, so it can still be restored.
+func (cfg *apiConfig) recordUnversionedFile(ctx context.Context, video database.Video) error {
+	if video.VideoURL == nil {
+		return nil
+	}
+	key, ok := cfg.getObjectKey(*video.VideoURL)
+	if !ok {
+		return nil
+	}
+
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.Key == key {
+			return nil
+		}
+	}
+
+	var size int64
+	info, err := cfg.storage.Stat(ctx, key)
+	if err == nil {
+		size = info.Size
+	} else {
+		log.Printf("Couldn't stat %s while recording it as a version: %v", key, err)
+	}
+
+	_, err = cfg.db.CreateVideoVersion(database.CreateVideoVersionParams{
+		VideoID:    video.ID,
+		Key:        key,
+		Size:       size,
+		UploaderID: video.UserID,
+	})
+	return err
+}
+
+// processVideo normalizes a raw upload (see normalizeVideo), probes the result
+// and uploads it under its orientation.
+func (cfg *apiConfig) processVideo(ctx context.Context, upload rawUpload) (string, videoProbe, error) {
+	progress := upload.progress
+	progress.startStage(progressStageTranscoding)
+	processedPath, chapterOffset, outroLength, err := cfg.normalizeVideo(ctx, upload, progress.update)
+	if err != nil {
+		return "", videoProbe{}, fmt.Errorf("couldn't normalize video: %w", err)
+	}
+	defer os.Remove(processedPath)
+
+	mediaInfo, err := cfg.probeMedia(ctx, processedPath)
+	if err != nil {
+		return "", videoProbe{}, fmt.Errorf("couldn't probe video: %w", err)
+	}
+
+	processedFile, err := os.Open(processedPath)
+	if err != nil {
+		return "", videoProbe{}, fmt.Errorf("couldn't open processed file: %w", err)
+	}
+	defer processedFile.Close()
+	processedInfo, err := processedFile.Stat()
+	if err != nil {
+		return "", videoProbe{}, fmt.Errorf("couldn't stat processed file: %w", err)
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return "", videoProbe{}, fmt.Errorf("couldn't generate random bytes: %w", err)
+	}
+	fileKey := fmt.Sprintf("%v/%x.mp4", mediaInfo.Orientation, randomBytes)
+
+	progress.startStage(progressStageUploading)
+	err = cfg.storage.Put(ctx, fileKey, processedFile, storage.PutOptions{
+		ContentType: "video/mp4",
+		Progress:    progress.byteProgress(processedInfo.Size()),
+	})
+	if err != nil {
+		return "", videoProbe{}, fmt.Errorf("couldn't upload file to storage: %w", err)
+	}
+	return fileKey, videoProbe{AspectRatio: mediaInfo.AspectRatio, MediaInfo: &mediaInfo, ChapterOffset: chapterOffset, OutroLength: outroLength}, nil
+}